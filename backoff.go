@@ -0,0 +1,223 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff is a composable exponential backoff configuration, following the semantics of cenkalti/backoff. The n-th
+// sleep is Initial * Multiplier^(n-1), capped at Max and randomized by RandomizationFactor into the range
+// [sleep - RandomizationFactor*sleep, sleep + RandomizationFactor*sleep], while still respecting Max.
+type Backoff struct {
+	Initial             time.Duration // Sleep after the first failed attempt
+	Max                 time.Duration // Upper bound of a sleep, 0 means no bound
+	Multiplier          float64       // Growth factor of the sleeps, 0 is treated as 1 meaning a constant sleep
+	RandomizationFactor float64       // Randomization of the sleeps in [0,1], 0 means no randomization
+}
+
+// Func returns a function computing the sleep duration from the current number of attempts, randomized by the
+// passed in source. A nil source defaults to the math/rand one.
+func (b Backoff) Func(src rand.Source) func(int) time.Duration {
+	r := &Retryer{}
+	if src != nil {
+		r.Rand = rand.New(src)
+	}
+	return func(attempts int) time.Duration {
+		return b.next(r, attempts)
+	}
+}
+
+// next computes the sleep duration after the attempt, using the random source of the Retryer.
+func (b Backoff) next(r *Retryer, attempts int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier == 0 {
+		multiplier = 1
+	}
+
+	d := exponential(b.Initial, multiplier, attempts)
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	d = r.jitter(d, b.RandomizationFactor)
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// WithBackoff configures the Retryer to sleep after each failed attempt for the duration computed by the Backoff. The
+// randomization uses the random source of the Retryer. The sequence of sleeps starts over with each call of Do.
+func WithBackoff(b Backoff) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BackoffFn, r.strategy = nil, b.next
+	}
+}
+
+// ExponentialBackoff configures the Retryer to sleep after each failed attempt for base * factor^(n-1), where n is the
+// current number of attempts, randomized by jitterFraction into [sleep - jitterFraction*sleep, sleep +
+// jitterFraction*sleep]. The fraction is clamped to [0,1], 0 means no jitter. The sleep is capped by MaxSleep, if set.
+func ExponentialBackoff(base time.Duration, factor, jitterFraction float64) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BackoffFn, r.strategy = nil, func(r *Retryer, attempts int) time.Duration {
+			return r.jitter(exponential(base, factor, attempts), jitterFraction)
+		}
+	}
+}
+
+// DecorrelatedJitter configures the Retryer to sleep after each failed attempt for a random duration between base and
+// three times the previous sleep, randomized further by jitterFraction the same way as by ExponentialBackoff and capped
+// at maxSleep. A maxSleep of 0 means no cap, the same as with MaxSleep. The sequence of sleeps starts over with each
+// call of Do.
+func DecorrelatedJitter(base, maxSleep time.Duration, jitterFraction float64) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BackoffFn, r.strategy = nil, decorrelatedJitter(base, maxSleep, jitterFraction)
+	}
+}
+
+// decorrelatedJitter returns a function computing the sleep durations of the decorrelated jitter strategy, keeping the
+// previous sleep in the Retryer. The previous sleep is reset to base on the first attempt and after a success with
+// ResetBackoffOnSuccess.
+func decorrelatedJitter(base, maxSleep time.Duration, jitterFraction float64) func(*Retryer, int) time.Duration {
+	return func(r *Retryer, attempts int) time.Duration {
+		prev := r.backoffPrev
+		if attempts <= 1 || prev == 0 {
+			prev = base
+		}
+
+		// the upper bound saturates, so that an uncapped sequence doesn't overflow
+		sleep, upper := base, time.Duration(math.MaxInt64)
+		if prev < upper/3 {
+			upper = 3 * prev
+		}
+		if upper > base {
+			sleep += time.Duration(r.int63n(int64(upper - base)))
+		}
+		sleep = r.jitter(sleep, jitterFraction)
+		if maxSleep > 0 && sleep > maxSleep {
+			sleep = maxSleep
+		}
+
+		r.backoffPrev = sleep
+		return sleep
+	}
+}
+
+// FibonacciBackoff configures the Retryer to sleep after each failed attempt for the base multiplied by the n-th number
+// of the Fibonacci sequence, where n is the current number of attempts (1, 1, 2, 3, 5, 8... times base), randomized by
+// jitterFraction the same way as by ExponentialBackoff. The sequence starts over with each call of Do and the sleep is
+// capped by MaxSleep, if set.
+func FibonacciBackoff(base time.Duration, jitterFraction float64) func(*Retryer) {
+	next := fibonacci(base)
+	return func(r *Retryer) {
+		r.BackoffFn, r.strategy = nil, func(r *Retryer, attempts int) time.Duration {
+			return r.jitter(next(attempts), jitterFraction)
+		}
+	}
+}
+
+// fibonacci returns a function computing the sleep durations of the Fibonacci backoff strategy, saturating at the
+// maximal duration instead of overflowing.
+func fibonacci(base time.Duration) func(int) time.Duration {
+	return func(attempts int) time.Duration {
+		a, b := time.Duration(0), time.Duration(1)
+		for i := 0; i < attempts; i++ {
+			a, b = b, a+b
+			if a < 0 || base > 0 && a > math.MaxInt64/base {
+				return math.MaxInt64
+			}
+		}
+		return a * base
+	}
+}
+
+// FullJitterBackoff configures the Retryer to sleep after each failed attempt for a random duration between 0 and an
+// exponentially growing ceiling of base * factor^(n-1), where n is the current number of attempts. The ceiling is
+// randomized by jitterFraction the same way as by ExponentialBackoff and capped by MaxSleep, if set.
+func FullJitterBackoff(base time.Duration, factor, jitterFraction float64) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BackoffFn, r.strategy = nil, fullJitter(base, factor, jitterFraction)
+	}
+}
+
+// fullJitter returns a function computing the sleep durations of the full jitter strategy.
+func fullJitter(base time.Duration, factor, jitterFraction float64) func(*Retryer, int) time.Duration {
+	return func(r *Retryer, attempts int) time.Duration {
+		ceiling := r.jitter(exponential(base, factor, attempts), jitterFraction)
+		if r.MaxSleep > 0 && ceiling > r.MaxSleep {
+			ceiling = r.MaxSleep
+		}
+		if ceiling <= 0 {
+			return 0
+		}
+		// the saturated ceiling is excluded, as the inclusive bound would overflow
+		if ceiling == math.MaxInt64 {
+			return time.Duration(r.int63n(int64(ceiling)))
+		}
+		return time.Duration(r.int63n(int64(ceiling) + 1))
+	}
+}
+
+// Schedule returns the sleep durations, which the Retryer would use after each of the first n failed attempts, without
+// running anything or sleeping, e.g. to preview a backoff configuration. The jittered strategies use a fixed seed, so
+// the schedule is the same on each call. The durations of the SleepFn variants, which sleep on their own, are unknown
+// and reported as 0. It returns nil, if a run of the Retryer is in progress.
+func (r *Retryer) Schedule(n int) []time.Duration {
+	if n <= 0 || !r.begin() {
+		return nil
+	}
+	defer r.end()
+
+	src, prev := r.Rand, r.backoffPrev
+	r.Rand = rand.New(rand.NewSource(1))
+	defer func() { r.Rand, r.backoffPrev = src, prev }()
+
+	schedule := make([]time.Duration, n)
+	if r.customSleep() {
+		return schedule
+	}
+	for i := range schedule {
+		schedule[i] = r.backoff(nil, i+1)
+	}
+	return schedule
+}
+
+// exponential computes base * factor^(attempts-1), saturating at the maximal duration instead of overflowing.
+func exponential(base time.Duration, factor float64, attempts int) time.Duration {
+	d := float64(base) * math.Pow(factor, float64(attempts-1))
+	if d >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(d)
+}
+
+// jitter randomizes the duration by the fraction, clamped to [0,1], into [d - fraction*d, d + fraction*d] using the
+// random source of the Retryer. The fraction of 0 means no jitter.
+func (r *Retryer) jitter(d time.Duration, fraction float64) time.Duration {
+	fraction = min(max(fraction, 0), 1)
+	if fraction == 0 || d <= 0 {
+		return d
+	}
+	delta := fraction * float64(d)
+	jittered := float64(d) - delta + r.float64()*(2*delta+1)
+	if jittered >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(jittered)
+}
+
+// int63n returns a random number in [0,n) from the configured random source.
+func (r *Retryer) int63n(n int64) int64 {
+	if r.Rand != nil {
+		return r.Rand.Int63n(n)
+	}
+	return rand.Int63n(n)
+}
+
+// float64 returns a random number in [0.0,1.0) from the configured random source.
+func (r *Retryer) float64() float64 {
+	if r.Rand != nil {
+		return r.Rand.Float64()
+	}
+	return rand.Float64()
+}
@@ -0,0 +1,461 @@
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDecorrelatedJitter(t *testing.T) {
+	t.Parallel()
+
+	base, maxSleep := 10*time.Millisecond, 500*time.Millisecond
+	r := New(RandSource(rand.NewSource(42)))
+	strategy := decorrelatedJitter(base, maxSleep, 0)
+	next := func(attempts int) time.Duration { return strategy(r, attempts) }
+
+	// two runs, the sequence has to start over with the first attempt
+	for run := 0; run < 2; run++ {
+		prev := base
+		for attempt := 1; attempt <= 20; attempt++ {
+			sleep := next(attempt)
+
+			upper := 3 * prev
+			if upper > maxSleep {
+				upper = maxSleep
+			}
+			if sleep < base || sleep > upper {
+				t.Errorf("run %d attempt %d: sleep %v out of bounds [%v, %v]", run, attempt, sleep, base, upper)
+			}
+			prev = sleep
+		}
+	}
+}
+
+func TestDecorrelatedJitterUncapped(t *testing.T) {
+	t.Parallel()
+
+	// a maxSleep of 0 doesn't cap the sleeps
+	base := 10 * time.Millisecond
+	r := New(RandSource(rand.NewSource(42)))
+	strategy := decorrelatedJitter(base, 0, 0)
+	for attempt := 1; attempt <= 20; attempt++ {
+		if sleep := strategy(r, attempt); sleep < base {
+			t.Errorf("attempt %d: sleep %v below the base %v", attempt, sleep, base)
+		}
+	}
+
+	// the upper bound saturates instead of overflowing
+	r.backoffPrev = math.MaxInt64 / 2
+	if sleep := strategy(r, 21); sleep < base {
+		t.Errorf("the saturated sleep shouldn't have overflowed, got %v", sleep)
+	}
+}
+
+func TestDecorrelatedJitterDeterministic(t *testing.T) {
+	t.Parallel()
+
+	base, maxSleep := 10*time.Millisecond, time.Second
+	strategy := decorrelatedJitter(base, maxSleep, 0)
+	a, b := New(RandSource(rand.NewSource(7))), New(RandSource(rand.NewSource(7)))
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		if sa, sb := strategy(a, attempt), strategy(b, attempt); sa != sb {
+			t.Errorf("attempt %d: sleeps differ for the same random source, %v and %v", attempt, sa, sb)
+		}
+	}
+}
+
+func TestDecorrelatedJitterOption(t *testing.T) {
+	t.Parallel()
+
+	r := New(DecorrelatedJitter(time.Millisecond, 5*time.Millisecond, 0), Tries(4))
+	if r.strategy == nil {
+		t.Fatal("backoff strategy should have been configured")
+	}
+
+	start := time.Now()
+	if err := r.Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if d := time.Since(start); d < 4*time.Millisecond {
+		t.Errorf("retryer didn't sleep for the minimal duration, ended after %v", d)
+	}
+}
+
+func TestResetBackoffOnSuccess(t *testing.T) {
+	t.Parallel()
+
+	// resumed runs don't start with the first attempt, so the sequence isn't started over on its own
+	run := func(r *Retryer, fn func() error) []time.Duration {
+		s := &recordingSleeper{}
+		r.sleep = s.sleep
+		_ = r.Do(fn)
+		return s.slept
+	}
+	base := 10 * time.Millisecond
+	for _, reset := range []bool{false, true} {
+		opts := []func(*Retryer){DecorrelatedJitter(base, time.Hour, 0), StartAttempt(2), Tries(8),
+			RandSource(rand.NewSource(9))}
+		if reset {
+			opts = append(opts, ResetBackoffOnSuccess())
+		}
+		r := New(opts...)
+
+		burst := run(r, sad)
+		run(r, happy)
+		next := run(r, sad)
+
+		// the seeded source makes the continued sequence exceed the bounds of the first sleep
+		upper := 3 * base
+		switch {
+		case reset && (next[0] < base || next[0] > upper):
+			t.Errorf("after a success the sequence should have started over, got %v out of [%v, %v]", next[0], base, upper)
+		case !reset && next[0] <= upper:
+			t.Errorf("without a reset the sequence should have continued from %v, got %v", burst[len(burst)-1], next[0])
+		}
+	}
+
+	// with NoAutoReset, the previous sleep is reset, whereas the attempts based strategies follow the # of attempts
+	flaky := func() func() error {
+		calls := 0
+		return func() error {
+			calls++
+			if calls%4 == 0 {
+				return nil
+			}
+			return sad()
+		}
+	}
+	strategies := map[string]struct {
+		opt   func(*Retryer)
+		check func(d time.Duration) bool
+	}{
+		"decorrelated": {DecorrelatedJitter(base, time.Hour, 0), func(d time.Duration) bool { return d <= 3*base }},
+		"exponential":  {ExponentialBackoff(base, 2, 0), func(d time.Duration) bool { return d == 16*base }},
+		"fibonacci":    {FibonacciBackoff(base, 0), func(d time.Duration) bool { return d == 5*base }},
+	}
+	for name, s := range strategies {
+		r := New(s.opt, NoAutoReset(), ResetBackoffOnSuccess(), Tries(10), RandSource(rand.NewSource(9)))
+		fn := flaky()
+		run(r, fn)
+		next := run(r, fn)
+		if len(next) == 0 || !s.check(next[0]) {
+			t.Errorf("%s: unexpected first sleep after the success, got %v", name, next)
+		}
+	}
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+	t.Parallel()
+
+	r := New(FibonacciBackoff(100*time.Millisecond, 0))
+	want := []time.Duration{100, 100, 200, 300, 500, 800}
+
+	// two runs, the sequence has to start over with the first attempt
+	for run := 0; run < 2; run++ {
+		for i, w := range want {
+			if got := r.backoff(nil, i+1); got != w*time.Millisecond {
+				t.Errorf("run %d attempt %d: got %v want %v", run, i+1, got, w*time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestFibonacciBackoffSleeps(t *testing.T) {
+	t.Parallel()
+
+	r := New(FibonacciBackoff(100*time.Millisecond, 0), InitialDelay(time.Second), Tries(5))
+	s := &recordingSleeper{}
+	r.sleep = s.sleep
+
+	start := time.Now()
+	if err := r.Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("recording sleeper shouldn't have slept, ended after %v", d)
+	}
+
+	want := []time.Duration{time.Second, 100 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond,
+		300 * time.Millisecond, 500 * time.Millisecond}
+	if !reflect.DeepEqual(s.slept, want) {
+		t.Errorf("unexpected sleeps, got %v want %v", s.slept, want)
+	}
+}
+
+func TestFibonacciBackoffMaxSleep(t *testing.T) {
+	t.Parallel()
+
+	r := New(FibonacciBackoff(20*time.Millisecond, 0), MaxSleep(40*time.Millisecond), Tries(5))
+
+	// sleeps 20+20+40+40+40 ms instead of 20+20+40+60+100 ms, starting over with each run
+	for run := 0; run < 2; run++ {
+		s := &recordingSleeper{}
+		r.sleep = s.sleep
+
+		if err := r.Do(sad); err == nil {
+			t.Error("should have failed with an error")
+		}
+		want := []time.Duration{20 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+			40 * time.Millisecond, 40 * time.Millisecond}
+		if !reflect.DeepEqual(s.slept, want) {
+			t.Errorf("run %d: unexpected sleeps, got %v want %v", run, s.slept, want)
+		}
+	}
+}
+
+func TestFibonacciBackoffSaturates(t *testing.T) {
+	t.Parallel()
+
+	// high attempt counts saturate instead of overflowing into negative sleeps, which MaxSleep wouldn't cap
+	for _, base := range []time.Duration{1, 100 * time.Millisecond} {
+		next := fibonacci(base)
+		for _, attempt := range []int{55, 92, 93, 200} {
+			if got := next(attempt); got <= 0 {
+				t.Errorf("base %v attempt %d: sleep should have saturated, got %v", base, attempt, got)
+			}
+		}
+	}
+	if got := fibonacci(100 * time.Millisecond)(55); got != math.MaxInt64 {
+		t.Errorf("sleep should have saturated at the maximal duration, got %v", got)
+	}
+
+	r := New(FibonacciBackoff(100*time.Millisecond, 0), MaxSleep(time.Second))
+	if got := r.backoff(nil, 55); got != time.Second {
+		t.Errorf("saturated sleep should have been capped by MaxSleep, got %v want %v", got, time.Second)
+	}
+}
+
+func TestFullJitterBackoff(t *testing.T) {
+	t.Parallel()
+
+	base := 10 * time.Millisecond
+	r := New(RandSource(rand.NewSource(42)))
+	strategy := fullJitter(base, 2, 0)
+	next := func(attempts int) time.Duration { return strategy(r, attempts) }
+
+	for attempt := 1; attempt <= 10; attempt++ {
+		ceiling := exponential(base, 2, attempt)
+		if want := base << uint(attempt-1); ceiling != want {
+			t.Errorf("attempt %d: ceiling should grow exponentially, got %v want %v", attempt, ceiling, want)
+		}
+		for i := 0; i < 100; i++ {
+			if sleep := next(attempt); sleep < 0 || sleep > ceiling {
+				t.Errorf("attempt %d: sleep %v out of bounds [0, %v]", attempt, sleep, ceiling)
+			}
+		}
+	}
+}
+
+func TestFullJitterBackoffSaturated(t *testing.T) {
+	t.Parallel()
+
+	// without MaxSleep the ceiling saturates at the maximal duration in the high attempts
+	r := New(FullJitterBackoff(100*time.Millisecond, 2, 0), RandSource(rand.NewSource(1)))
+	if s := r.Schedule(40); len(s) != 40 {
+		t.Errorf("unexpected schedule length, got %d want 40", len(s))
+	}
+	for _, attempt := range []int{38, 64, 1000} {
+		if sleep := r.backoff(nil, attempt); sleep < 0 {
+			t.Errorf("attempt %d: sleep %v out of bounds [0, %v]", attempt, sleep, time.Duration(math.MaxInt64))
+		}
+	}
+}
+
+func TestFullJitterBackoffMaxSleep(t *testing.T) {
+	t.Parallel()
+
+	r := New(FullJitterBackoff(10*time.Millisecond, 2, 0), MaxSleep(50*time.Millisecond), RandSource(rand.NewSource(1)))
+	for attempt := 1; attempt <= 100; attempt++ {
+		if sleep := r.backoff(nil, attempt); sleep < 0 || sleep > 50*time.Millisecond {
+			t.Errorf("attempt %d: sleep %v out of bounds [0, 50ms]", attempt, sleep)
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	base := 10 * time.Millisecond
+	r := New(ExponentialBackoff(base, 2, 0.25), RandSource(rand.NewSource(42)))
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := exponential(base, 2, attempt)
+		lower, upper := d-d/4, d+d/4
+		for i := 0; i < 100; i++ {
+			if got := r.backoff(nil, attempt); got < lower || got > upper {
+				t.Errorf("attempt %d: sleep %v out of bounds [%v, %v]", attempt, got, lower, upper)
+			}
+		}
+	}
+
+	// no jitter yields the plain exponential sleeps
+	r = New(ExponentialBackoff(base, 2, 0))
+	for attempt := 1; attempt <= 5; attempt++ {
+		if got, want := r.backoff(nil, attempt), base<<uint(attempt-1); got != want {
+			t.Errorf("attempt %d: got %v want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	t.Parallel()
+
+	d := 100 * time.Millisecond
+	for _, fraction := range []float64{-1, 0} {
+		if got := New().jitter(d, fraction); got != d {
+			t.Errorf("fraction %v: should have been clamped to no jitter, got %v", fraction, got)
+		}
+	}
+
+	// the fraction above 1 is clamped to 1, the same seed yields the same sleeps
+	a, b := New(RandSource(rand.NewSource(5))), New(RandSource(rand.NewSource(5)))
+	for i := 0; i < 100; i++ {
+		got, want := a.jitter(d, 3), b.jitter(d, 1)
+		if got != want {
+			t.Errorf("fraction 3 should have been clamped to 1, got %v want %v", got, want)
+		}
+		if got < 0 || got > 2*d {
+			t.Errorf("sleep %v out of bounds [0, %v]", got, 2*d)
+		}
+	}
+}
+
+func TestBackoffJitterFraction(t *testing.T) {
+	t.Parallel()
+
+	base := 10 * time.Millisecond
+	fib := fibonacci(base)
+	r := New(FibonacciBackoff(base, 0.2), RandSource(rand.NewSource(11)))
+	jittered := false
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := fib(attempt)
+		got := r.backoff(nil, attempt)
+		if lower, upper := d-d/5, d+d/5; got < lower || got > upper {
+			t.Errorf("fibonacci attempt %d: sleep %v out of bounds [%v, %v]", attempt, got, lower, upper)
+		}
+		jittered = jittered || got != d
+	}
+	if !jittered {
+		t.Error("fibonacci sleeps should have been jittered")
+	}
+
+	r = New(FullJitterBackoff(base, 2, 0.2), RandSource(rand.NewSource(11)))
+	for attempt := 1; attempt <= 10; attempt++ {
+		if got, upper := r.backoff(nil, attempt), exponential(base, 2, attempt)*6/5; got < 0 || got > upper {
+			t.Errorf("full jitter attempt %d: sleep %v out of bounds [0, %v]", attempt, got, upper)
+		}
+	}
+
+	maxSleep := time.Second
+	r = New(DecorrelatedJitter(base, maxSleep, 0.2), RandSource(rand.NewSource(11)))
+	for attempt := 1; attempt <= 10; attempt++ {
+		if got, lower := r.backoff(nil, attempt), base-base/5; got < lower || got > maxSleep {
+			t.Errorf("decorrelated jitter attempt %d: sleep %v out of bounds [%v, %v]", attempt, got, lower, maxSleep)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	t.Parallel()
+
+	ms := time.Millisecond
+	linear := func(attempts int) time.Duration { return time.Duration(attempts) * 100 * ms }
+	tests := []struct {
+		name string
+		r    *Retryer
+		want []time.Duration
+	}{
+		{"constant", New(SleepDuration(50 * ms)), []time.Duration{50 * ms, 50 * ms, 50 * ms}},
+		{"linear", New(BackoffFn(linear)), []time.Duration{100 * ms, 200 * ms, 300 * ms, 400 * ms}},
+		{"exponential", New(ExponentialBackoff(10*ms, 2, 0)), []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms}},
+		{"capped", New(ExponentialBackoff(10*ms, 2, 0), MaxSleep(30*ms)), []time.Duration{10 * ms, 20 * ms, 30 * ms}},
+		{"custom sleep", New(SleepFn(func(int) {})), []time.Duration{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Schedule(len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unexpected schedule, got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	// the jittered schedule is the same on each call and doesn't consume the configured source
+	src := rand.New(rand.NewSource(3))
+	r := New(ExponentialBackoff(10*ms, 2, 0.5))
+	r.Rand = src
+	if a, b := r.Schedule(5), r.Schedule(5); !reflect.DeepEqual(a, b) {
+		t.Errorf("jittered schedules differ, %v and %v", a, b)
+	}
+	if r.Rand != src || src.Int63() != rand.New(rand.NewSource(3)).Int63() {
+		t.Error("the random source of the Retryer should have been preserved")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	next := b.Func(nil)
+	want := []time.Duration{100, 200, 400, 800, 1000, 1000}
+
+	// two runs, the sequence has to start over with the first attempt
+	for run := 0; run < 2; run++ {
+		for i, w := range want {
+			if got := next(i + 1); got != w*time.Millisecond {
+				t.Errorf("run %d attempt %d: got %v want %v", run, i+1, got, w*time.Millisecond)
+			}
+		}
+	}
+}
+
+func TestBackoffRandomization(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Initial: 100 * time.Millisecond, Max: 2 * time.Second, Multiplier: 1.5, RandomizationFactor: 0.5}
+	next := b.Func(rand.NewSource(42))
+
+	for attempt := 1; attempt <= 12; attempt++ {
+		d := exponential(b.Initial, b.Multiplier, attempt)
+		if d > b.Max {
+			d = b.Max
+		}
+		lower, upper := d/2, d+d/2
+		if upper > b.Max {
+			upper = b.Max
+		}
+
+		for i := 0; i < 100; i++ {
+			if got := next(attempt); got < lower || got > upper {
+				t.Errorf("attempt %d: sleep %v out of bounds [%v, %v]", attempt, got, lower, upper)
+			}
+		}
+	}
+}
+
+func TestWithBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := Backoff{Initial: 10 * time.Millisecond, Multiplier: 2, RandomizationFactor: 0.1}
+	r1 := New(WithBackoff(b), RandSource(rand.NewSource(3)))
+	r2 := New(RandSource(rand.NewSource(3)))
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		if got, want := r1.backoff(nil, attempt), b.next(r2, attempt); got != want {
+			t.Errorf("attempt %d: backoff should have used the random source of the Retryer, got %v want %v", attempt, got, want)
+		}
+	}
+}
+
+// recordingSleeper records the requested sleep durations without actually sleeping.
+type recordingSleeper struct {
+	slept []time.Duration
+}
+
+func (s *recordingSleeper) sleep(ctx context.Context, d time.Duration) error {
+	s.slept = append(s.slept, d)
+	return ctx.Err()
+}
@@ -0,0 +1,37 @@
+package retry
+
+import "sync/atomic"
+
+// Budget is a pool of retries, which can be shared by multiple Retryers to cap the total number of retries, e.g. per
+// request. Each retry consumes one token, the first attempt of a function is free. Budget is safe for concurrent use.
+type Budget struct {
+	tokens atomic.Int64
+}
+
+// NewBudget creates a Budget with the number of tokens.
+func NewBudget(tokens int) *Budget {
+	b := &Budget{}
+	b.tokens.Store(int64(tokens))
+	return b
+}
+
+// Remaining returns the number of tokens left in the Budget.
+func (b *Budget) Remaining() int {
+	if n := b.tokens.Load(); n > 0 {
+		return int(n)
+	}
+	return 0
+}
+
+// take consumes a token, reporting whether there was any left.
+func (b *Budget) take() bool {
+	for {
+		n := b.tokens.Load()
+		if n <= 0 {
+			return false
+		}
+		if b.tokens.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
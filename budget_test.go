@@ -0,0 +1,108 @@
+package retry
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBudget(t *testing.T) {
+	t.Parallel()
+
+	b := NewBudget(5)
+
+	// 1 free attempt and 3 retries
+	r1 := New(Tries(4), WithBudget(b))
+	err := r1.Do(sad)
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+	}
+	if b.Remaining() != 2 {
+		t.Errorf("incorrect remaining tokens, got %d want 2", b.Remaining())
+	}
+
+	// 1 free attempt and the 2 remaining retries
+	r2 := New(Tries(10), WithBudget(b))
+	err = r2.Do(sad)
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("expected the budget exhausted error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), sad().Error()) {
+		t.Errorf("expected the last error to be reported, got %v", err)
+	}
+	if r2.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r2.Attempts())
+	}
+	if b.Remaining() != 0 {
+		t.Errorf("incorrect remaining tokens, got %d want 0", b.Remaining())
+	}
+
+	// the first attempt is free even with an exhausted budget
+	if err := New(WithBudget(b)).Do(happy); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+}
+
+func TestBudgetExhaustedWithoutSleep(t *testing.T) {
+	t.Parallel()
+
+	// the exhausted budget is detected before the sleep, not after it
+	r := New(Tries(5), Sleep(1000), WithBudget(NewBudget(1)))
+	s := &recordingSleeper{}
+	r.sleep = s.sleep
+
+	if err := r.Do(sad); !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("expected the budget exhausted error, got %v", err)
+	}
+	if r.Attempts() != 2 || len(s.slept) != 1 {
+		t.Errorf("should have slept only before the single retry, got %d attempts and sleeps %v", r.Attempts(), s.slept)
+	}
+}
+
+func TestBudgetResetOn(t *testing.T) {
+	t.Parallel()
+
+	// the retries after the errors resetting the attempts consume the budget as well
+	b := NewBudget(1)
+	calls := 0
+	r := New(Tries(3), ResetOn([]error{errorTypeB{}}), WithBudget(b))
+
+	err := r.Do(func() error {
+		calls++
+		return errorTypeB{s: "progressing"}
+	})
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("expected the budget exhausted error, got %v", err)
+	}
+	if calls != 2 || b.Remaining() != 0 {
+		t.Errorf("should have retried once on the budget, got %d calls and %d remaining tokens", calls, b.Remaining())
+	}
+}
+
+func TestBudgetConcurrent(t *testing.T) {
+	t.Parallel()
+
+	b := NewBudget(100)
+	var mu sync.Mutex
+	retries := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := New(Tries(0), AllowInfinite(), WithBudget(b))
+			r.Do(sad)
+
+			mu.Lock()
+			retries += r.Attempts() - 1
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if retries != 100 {
+		t.Errorf("total number of retries should have been capped by the budget, got %d want 100", retries)
+	}
+}
@@ -0,0 +1,23 @@
+package retry
+
+import "fmt"
+
+// DoFallback calls the passed in function through the Retryer and, once it fails, falls back to calling fallbackFn
+// through the next Retryer, e.g. retrying a primary replica 3 times before switching to a secondary one. A nil next
+// Retryer runs the fallback with the same configuration. If both of them fail, the returned error wraps the errors
+// of both, so that errors.Is and errors.As match either of them.
+func (r *Retryer) DoFallback(fn func() error, next *Retryer, fallbackFn func() error) error {
+	err := r.Do(fn)
+	if err == nil {
+		return nil
+	}
+
+	if next == nil {
+		next = r
+	}
+	fallbackErr := next.Do(fallbackFn)
+	if fallbackErr == nil {
+		return nil
+	}
+	return fmt.Errorf("retry: %w, fallback: %w", err, fallbackErr)
+}
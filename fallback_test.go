@@ -0,0 +1,39 @@
+package retry
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDoFallback(t *testing.T) {
+	t.Parallel()
+
+	// the primary exhausts its tries, the fallback succeeds
+	primary, fallback := New(Tries(3)), New(Tries(2))
+	primaryCalls, fallbackCalls := 0, 0
+	err := primary.DoFallback(func() error {
+		primaryCalls++
+		return errorTypeA{}
+	}, fallback, func() error {
+		fallbackCalls++
+		return nil
+	})
+	if err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if primaryCalls != 3 || fallbackCalls != 1 || !fallback.Succeeded() {
+		t.Errorf("expected 3 primary and 1 fallback calls, got %d and %d", primaryCalls, fallbackCalls)
+	}
+
+	// a succeeding primary doesn't fall back
+	fallbackCalls = 0
+	if err := primary.DoFallback(happy, fallback, func() error { fallbackCalls++; return nil }); err != nil || fallbackCalls != 0 {
+		t.Errorf("expected success without falling back, got %v after %d fallback calls", err, fallbackCalls)
+	}
+
+	// both of them fail, the error combines both
+	err = primary.DoFallback(func() error { return errorTypeA{} }, nil, func() error { return errorTypeB{} })
+	if !errors.Is(err, ErrMaxRetries) || !errors.As(err, new(errorTypeA)) || !errors.As(err, new(errorTypeB)) {
+		t.Errorf("expected the combined error of both, got %v", err)
+	}
+}
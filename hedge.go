@@ -0,0 +1,212 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DoHedged calls the passed in function concurrently in up to n goroutines and returns as soon as one of the attempts
+// succeeds, ignoring the results of the others. A failed attempt is replaced with a new one, while the total number of
+// attempts is bounded by Tries. If HedgeDelay is set, the concurrent attempts are staggered by it, otherwise all of
+// them start right away. With Recover or RecoverAndRetry enabled, panics are recovered in each of the goroutines and
+// handled as failed attempts, without being reported to the Logger, whereas the panics, which RecoverIf doesn't
+// recover, are re-panicked in the goroutine of DoHedged. An attempt exiting its goroutine by a call of runtime.Goexit
+// stops DoHedged with ErrGoexit.
+//
+// The callbacks, the Observer, the event channel, the Logger, the Budget, the stop channel, Timeout, InitialDelay and
+// StartAttempt are honoured the same way as by Do, all of them in the goroutine of DoHedged. The Middleware wraps the
+// function in each of the concurrent goroutines, so it has to be safe for concurrent use. The sleep options, ResetOn,
+// ExtendTriesOn and StopIfUnchanged are not used.
+func (r *Retryer) DoHedged(n int, fn func() error) (err error) {
+	if !r.begin() {
+		return ErrConcurrentDo
+	}
+	defer r.end()
+	if !r.NoAutoReset {
+		r.Reset()
+	}
+	if r.attempts == 0 && r.StartAttempt > 1 {
+		r.attempts = r.StartAttempt - 1
+	}
+
+	if fn == nil {
+		return ErrNilFunc
+	}
+	fn = r.wrap(fn)
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if err := r.checkInfinite(ctx); err != nil {
+		return err
+	}
+	if n < 1 {
+		n = 1
+	}
+
+	// define the deferred functions in the same order as Do does
+	if r.Events != nil {
+		defer func() { r.emit(Event{Attempt: r.attempts, Err: err, Done: true}) }()
+	}
+	if r.Observer != nil {
+		start := time.Now()
+		defer func() { r.Observer.Finished(r.attempts, err, time.Since(start)) }()
+	}
+	if r.EnsureFn != nil {
+		defer func() { r.EnsureFn(err) }()
+	}
+	if r.EnsureCtxFn != nil {
+		defer func() { r.EnsureCtxFn(ctx, err) }()
+	}
+	if r.StopCh != nil {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = r.withStop(ctx)
+		defer cancel(nil)
+	}
+
+	if r.InitialDelay != 0 {
+		if err := r.pause(ctx, r.InitialDelay); err != nil {
+			return r.interrupted(ctx, err, nil)
+		}
+	}
+
+	// at most n attempts are in flight, so none of them blocks on sending its result after DoHedged returns
+	results := make(chan error, n)
+	inFlight, launched := 0, 0
+	budgetExhausted := false
+
+	for {
+		if stopErr := r.stopped(ctx); stopErr != nil {
+			return r.interrupted(ctx, stopErr, err)
+		}
+
+		// the first attempt is free, each of the others consumes a token of the budget
+		launch := inFlight < n && !budgetExhausted && (r.Tries <= 0 || r.attempts < r.Tries)
+		if launch && launched > 0 && r.Budget != nil && !r.Budget.take() {
+			launch, budgetExhausted = false, true
+		}
+		if launch {
+			r.attempts++
+			inFlight++
+			launched++
+			if r.Observer != nil {
+				r.Observer.AttemptStarted(r.attempts)
+			}
+			if r.BeforeEachFn != nil {
+				r.BeforeEachFn(r.attempts)
+			}
+			go r.hedge(fn, results)
+
+			if r.HedgeDelay == 0 {
+				continue
+			}
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		var stagger *time.Timer
+		var next <-chan time.Time
+		if launch {
+			stagger = time.NewTimer(r.HedgeDelay)
+			next = stagger.C
+		}
+
+		select {
+		case err = <-results:
+			inFlight--
+		case <-next:
+			continue
+		case <-ctx.Done():
+			if stagger != nil {
+				stagger.Stop()
+			}
+			return r.interrupted(ctx, context.Cause(ctx), err)
+		}
+		if stagger != nil {
+			stagger.Stop()
+		}
+
+		if p, ok := err.(*hedgedPanic); ok {
+			// the deferred functions see ErrGoexit, the same as with a panic, which isn't recovered, in Do
+			err = ErrGoexit
+			panic(p.value)
+		}
+		decision := r.classify(err)
+		if err == ErrGoexit {
+			decision = DecisionStop
+		}
+		switch decision {
+		case DecisionSuccess:
+			r.succeededOn = r.attempts
+			r.emit(Event{Attempt: r.attempts})
+			if r.OnSuccessFn != nil {
+				r.OnSuccessFn(r.attempts)
+			}
+			return nil
+		case DecisionStop:
+			r.observeFailed(err, 0)
+			return err
+		}
+		if r.CollectErrors {
+			r.errs = append(r.errs, err)
+		}
+		if r.AfterEachFailFn != nil {
+			r.AfterEachFailFn(err)
+		}
+		if r.AfterEachFailCtxFn != nil {
+			r.AfterEachFailCtxFn(ctx, err)
+		}
+		if r.AfterEachFailDecideFn != nil && r.AfterEachFailDecideFn(r.attempts, err) {
+			r.observeFailed(err, 0)
+			return r.giveUp(fmt.Errorf("%w after %d attempts, last error %w", ErrAborted, r.attempts, err))
+		}
+		r.observeFailed(err, 0)
+		if inFlight > 0 || !budgetExhausted && (r.Tries <= 0 || r.attempts < r.Tries) {
+			r.logger().Retrying(r.attempts, err)
+		}
+	}
+
+	if budgetExhausted {
+		return r.giveUp(fmt.Errorf("%w after %d attempts, last error %w", ErrBudgetExhausted, r.attempts, err))
+	}
+	return r.giveUp(r.exhausted(err))
+}
+
+// hedge runs a single hedged attempt, sending its outcome to the results channel.
+func (r *Retryer) hedge(fn func() error, results chan<- error) {
+	sent := false
+	defer func() {
+		// the function exited the goroutine by a call of runtime.Goexit, DoHedged mustn't wait for it forever
+		if !sent {
+			results <- ErrGoexit
+		}
+	}()
+	if r.Recover || r.RecoverAndRetry {
+		defer func() {
+			if p := recover(); p != nil {
+				sent = true
+				if !r.recoverable(p) {
+					results <- &hedgedPanic{value: p}
+					return
+				}
+				results <- r.recovered(p)
+			}
+		}()
+	}
+	err := fn()
+	sent = true
+	results <- err
+}
+
+// hedgedPanic carries the value of a panic, which isn't recovered, from a hedged attempt to the goroutine of DoHedged.
+type hedgedPanic struct {
+	value any
+}
+
+func (p *hedgedPanic) Error() string {
+	return fmt.Sprintf("retry: hedged attempt panicked: %v", p.value)
+}
@@ -0,0 +1,210 @@
+package retry
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoHedged(t *testing.T) {
+	t.Parallel()
+
+	// the first call is slow and fails, the second one succeeds right away
+	var calls atomic.Int32
+	fn := func() error {
+		if calls.Add(1) == 1 {
+			time.Sleep(time.Second)
+			return errors.New("slow replica")
+		}
+		return nil
+	}
+
+	r := New(Tries(5))
+	start := time.Now()
+	if err := r.DoHedged(3, fn); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("should have returned with the first success, took %v", d)
+	}
+	if !r.Succeeded() {
+		t.Error("should have reported success")
+	}
+}
+
+func TestDoHedgedAllFail(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	fn := func() error {
+		calls.Add(1)
+		return errors.New("replica down")
+	}
+
+	var fails int
+	r := New(Tries(6), AfterEachFail(func(error) { fails++ }))
+	err := r.DoHedged(3, fn)
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+	}
+	if calls.Load() != 6 || r.Attempts() != 6 || fails != 6 {
+		t.Errorf("should have made 6 attempts in total, got %d calls, %d attempts and %d fails", calls.Load(), r.Attempts(), fails)
+	}
+}
+
+func TestDoHedgedStagger(t *testing.T) {
+	t.Parallel()
+
+	// the first call succeeds within the stagger delay, no other attempt is started
+	var calls atomic.Int32
+	fn := func() error {
+		calls.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+
+	if err := New(HedgeDelay(200*time.Millisecond)).DoHedged(3, fn); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("should have started a single attempt, got %d", calls.Load())
+	}
+}
+
+func TestDoHedgedRecover(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("hedged retryer with panic recovery shouldn't have panicked: %v", r)
+		}
+	}()
+
+	var calls atomic.Int32
+	fn := func() error {
+		if calls.Add(1) == 1 {
+			panic("explicit trigger of panic")
+		}
+		return nil
+	}
+
+	if err := New(Recover(), HedgeDelay(10*time.Millisecond)).DoHedged(2, fn); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+}
+
+func TestDoHedgedRecoverIf(t *testing.T) {
+	t.Parallel()
+
+	// the panic, which isn't recovered, propagates out of DoHedged instead of crashing its goroutine
+	var ensured error
+	r := New(RecoverIf(func(any) bool { return false }), Ensure(func(err error) { ensured = err }))
+	func() {
+		defer func() {
+			if p := recover(); p != "explicit trigger of panic" {
+				t.Errorf("DoHedged should have re-panicked with the value of the panic, got %v", p)
+			}
+		}()
+		_ = r.DoHedged(2, panicked)
+	}()
+	if !errors.Is(ensured, ErrGoexit) {
+		t.Errorf("ensure function should have been called with ErrGoexit, got %v", ensured)
+	}
+	if err := r.DoHedged(2, func() error { return nil }); err != nil {
+		t.Errorf("the Retryer should be reusable after the panic, got %v", err)
+	}
+}
+
+func TestDoHedgedGoexit(t *testing.T) {
+	t.Parallel()
+
+	r := New(Tries(3))
+	done := make(chan error, 1)
+	go func() {
+		done <- r.DoHedged(2, func() error {
+			runtime.Goexit()
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrGoexit) {
+			t.Errorf("expected ErrGoexit, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("DoHedged should have returned after the attempt exited its goroutine")
+	}
+	if err := r.DoHedged(2, func() error { return nil }); err != nil {
+		t.Errorf("the Retryer should be reusable after the exited attempt, got %v", err)
+	}
+}
+
+func TestDoHedgedStopChan(t *testing.T) {
+	t.Parallel()
+
+	fail := func() error {
+		time.Sleep(time.Millisecond)
+		return errors.New("replica down")
+	}
+
+	// already closed channel, the function is not invoked at all
+	stop := make(chan struct{})
+	close(stop)
+	r := New(Tries(0), StopChan(stop))
+	if err := r.DoHedged(2, fail); !errors.Is(err, ErrStopped) || r.Attempts() != 0 {
+		t.Errorf("expected the stopped error without any attempts, got %v after %d attempts", err, r.Attempts())
+	}
+
+	// unlimited tries are interrupted by the stop channel and by the timeout
+	stop = make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(stop) })
+	if err := New(Tries(0), StopChan(stop)).DoHedged(2, fail); !errors.Is(err, ErrStopped) {
+		t.Errorf("expected the stopped error, got %v", err)
+	}
+	err := New(Tries(0), Timeout(20*time.Millisecond)).DoHedged(2, fail)
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || !retryErr.TimedOut {
+		t.Errorf("expected a timed out RetryError, got %v", err)
+	}
+}
+
+func TestDoHedgedCallbacks(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	fn := func() error {
+		if calls.Add(1) < 3 {
+			return errors.New("replica down")
+		}
+		return nil
+	}
+
+	var before, wrapped atomic.Int32
+	ensured, succeededOn := false, 0
+	mw := func(next func() error) func() error {
+		return func() error {
+			wrapped.Add(1)
+			return next()
+		}
+	}
+	r := New(Tries(5), Use(mw), BeforeEach(func(int) { before.Add(1) }), OnSuccess(func(n int) { succeededOn = n }),
+		Ensure(func(err error) { ensured = err == nil }))
+
+	if err := r.DoHedged(1, fn); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if before.Load() != 3 || wrapped.Load() != 3 || succeededOn != 3 || !ensured {
+		t.Errorf("callbacks should have been called for each attempt, got %d before each, %d wrapped, success on %d "+
+			"and ensured %v", before.Load(), wrapped.Load(), succeededOn, ensured)
+	}
+
+	// the budget caps the replacement attempts
+	b := NewBudget(1)
+	err := New(Tries(5), WithBudget(b)).DoHedged(1, func() error { return errors.New("replica down") })
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Errorf("expected the budget exhausted error, got %v", err)
+	}
+}
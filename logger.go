@@ -0,0 +1,56 @@
+package retry
+
+import "log"
+
+// Logger receives notifications about the notable events of a Retryer run, as an alternative to hand-written callbacks.
+type Logger interface {
+	// Retrying is called after a failed attempt, which is going to be retried.
+	Retrying(attempt int, err error)
+	// Exhausted is called once the Retryer gives up, with the error returned from Do. It's called whenever the retries
+	// end without a success, e.g. by the exhausted tries or Budget, a timeout, a stop or an abort, apart from the errors
+	// stopping the Retryer right away, e.g. the ones which aren't Retryable, and the panics ending the run.
+	Exhausted(attempts int, err error)
+	// Recovered is called with the value of each recovered panic.
+	Recovered(v any)
+}
+
+// NopLogger is a Logger, which discards all of the notifications. It's the default Logger of a Retryer.
+type NopLogger struct{}
+
+// Retrying implements Logger.
+func (NopLogger) Retrying(int, error) {}
+
+// Exhausted implements Logger.
+func (NopLogger) Exhausted(int, error) {}
+
+// Recovered implements Logger.
+func (NopLogger) Recovered(any) {}
+
+// StdLogger adapts the standard library *log.Logger to the Logger interface.
+func StdLogger(l *log.Logger) Logger {
+	return stdLogger{l: l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Retrying(attempt int, err error) {
+	s.l.Printf("retry: attempt %d failed, retrying: %v", attempt, err)
+}
+
+func (s stdLogger) Exhausted(attempts int, err error) {
+	s.l.Printf("retry: giving up after %d attempts: %v", attempts, err)
+}
+
+func (s stdLogger) Recovered(v any) {
+	s.l.Printf("retry: recovered panic: %v", v)
+}
+
+// logger returns the configured Logger, defaulting to NopLogger.
+func (r *Retryer) logger() Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return NopLogger{}
+}
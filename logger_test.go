@@ -0,0 +1,101 @@
+package retry
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithLogger(t *testing.T) {
+	t.Parallel()
+
+	l := &recordingLogger{}
+	if err := New(WithLogger(l), Tries(3)).Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	want := []string{"retrying 1", "retrying 2", "exhausted 3"}
+	if !reflect.DeepEqual(l.calls, want) {
+		t.Errorf("unexpected logger calls, got %v want %v", l.calls, want)
+	}
+
+	l = &recordingLogger{}
+	ab := attemptsBased{succeedOnNth: 2, fn: panicked}
+	if err := New(WithLogger(l), RecoverAndRetry(), Tries(3)).Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	want = []string{"recovered explicit trigger of panic", "retrying 1"}
+	if !reflect.DeepEqual(l.calls, want) {
+		t.Errorf("unexpected logger calls, got %v want %v", l.calls, want)
+	}
+
+	l = &recordingLogger{}
+	if err := New(WithLogger(l), Recover()).Do(panicked); err == nil {
+		t.Error("expected an error containing panic stacktrace")
+	}
+	want = []string{"recovered explicit trigger of panic"}
+	if !reflect.DeepEqual(l.calls, want) {
+		t.Errorf("unexpected logger calls, got %v want %v", l.calls, want)
+	}
+}
+
+func TestLoggerGiveUp(t *testing.T) {
+	t.Parallel()
+
+	stop := make(chan struct{})
+	close(stop)
+	tcs := []struct {
+		name string
+		opts []func(*Retryer)
+		want []string
+	}{
+		{"aborted", []func(*Retryer){AfterEachFailDecide(func(int, error) bool { return true })}, []string{"exhausted 1"}},
+		{"unchanged", []func(*Retryer){StopIfUnchanged(2)}, []string{"retrying 1", "exhausted 2"}},
+		{"budget", []func(*Retryer){WithBudget(NewBudget(0))}, []string{"exhausted 1"}},
+		{"stopped", []func(*Retryer){StopChan(stop)}, []string{"exhausted 0"}},
+		{"timed out", []func(*Retryer){Timeout(time.Millisecond), Sleep(1000)}, []string{"retrying 1", "exhausted 1"}},
+	}
+
+	for _, tc := range tcs {
+		l := &recordingLogger{}
+		if err := New(append(tc.opts, WithLogger(l), Tries(5))...).Do(sad); err == nil {
+			t.Errorf("%s: should have failed with an error", tc.name)
+		}
+		if !reflect.DeepEqual(l.calls, tc.want) {
+			t.Errorf("%s: unexpected logger calls, got %v want %v", tc.name, l.calls, tc.want)
+		}
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	l := StdLogger(log.New(&buf, "", 0))
+	New(WithLogger(l), Tries(2)).Do(sad)
+
+	out := buf.String()
+	if !strings.Contains(out, "retry: attempt 1 failed, retrying: error on primitive addition") ||
+		!strings.Contains(out, "retry: giving up after 2 attempts") {
+		t.Errorf("unexpected log output:\n%s", out)
+	}
+}
+
+type recordingLogger struct {
+	calls []string
+}
+
+func (l *recordingLogger) Retrying(attempt int, err error) {
+	l.calls = append(l.calls, fmt.Sprintf("retrying %d", attempt))
+}
+
+func (l *recordingLogger) Exhausted(attempts int, err error) {
+	l.calls = append(l.calls, fmt.Sprintf("exhausted %d", attempts))
+}
+
+func (l *recordingLogger) Recovered(v any) {
+	l.calls = append(l.calls, fmt.Sprintf("recovered %v", v))
+}
@@ -0,0 +1,42 @@
+package retry
+
+import "time"
+
+// Observer receives detailed notifications about each attempt of a Retryer run, including timing and backoff details,
+// e.g. to record metrics.
+type Observer interface {
+	// AttemptStarted is called right before each attempt with its number.
+	AttemptStarted(n int)
+	// AttemptFailed is called after each failed attempt with the duration of the following sleep. The backoff is 0, if
+	// the Retryer doesn't sleep or if the sleep is performed by one of the SleepFn variants.
+	AttemptFailed(n int, err error, backoff time.Duration)
+	// Finished is called once the run is over, with the error returned from Do and the elapsed duration of the run.
+	Finished(attempts int, err error, elapsed time.Duration)
+}
+
+// Event describes an attempt of a Retryer run, sent to the channel configured by EventChan.
+type Event struct {
+	Attempt   int           // Number of the attempt
+	Err       error         // Error of the attempt, or the error returned from Do in the final event
+	NextSleep time.Duration // Duration of the following sleep, 0 if unknown or if the Retryer doesn't sleep
+	Done      bool          // Whether the run is over, set only in the final event
+}
+
+// observeFailed notifies the observer and the event channel, if set, about a failed attempt.
+func (r *Retryer) observeFailed(err error, backoff time.Duration) {
+	if r.Observer != nil {
+		r.Observer.AttemptFailed(r.attempts, err, backoff)
+	}
+	r.emit(Event{Attempt: r.attempts, Err: err, NextSleep: backoff})
+}
+
+// emit sends the event to the event channel, if set, dropping the event if the channel isn't ready to receive it.
+func (r *Retryer) emit(e Event) {
+	if r.Events == nil {
+		return
+	}
+	select {
+	case r.Events <- e:
+	default:
+	}
+}
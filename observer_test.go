@@ -0,0 +1,129 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWithObserver(t *testing.T) {
+	t.Parallel()
+
+	o := &recordingObserver{}
+	r := New(WithObserver(o), SleepDuration(30*time.Millisecond), Tries(3))
+	r.sleep = (&recordingSleeper{}).sleep
+
+	err := r.Do(sad)
+	if err == nil {
+		t.Error("should have failed with an error")
+	}
+
+	want := []string{
+		"started 1", "failed 1 30ms",
+		"started 2", "failed 2 30ms",
+		"started 3", "failed 3 30ms",
+		"finished 3",
+	}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("unexpected observer events, got %v want %v", o.events, want)
+	}
+	if o.err != err {
+		t.Errorf("observer should have received the returned error, got %v want %v", o.err, err)
+	}
+
+	// success and a non-retryable stop
+	o = &recordingObserver{}
+	ab := attemptsBased{succeedOnNth: 2, fn: sad}
+	New(WithObserver(o), BackoffFn(func(n int) time.Duration { return time.Duration(n) * time.Millisecond })).Do(ab.run)
+	want = []string{"started 1", "failed 1 1ms", "started 2", "finished 2"}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("unexpected observer events, got %v want %v", o.events, want)
+	}
+	if o.err != nil {
+		t.Errorf("observer should have received nil error, got %v", o.err)
+	}
+
+	o = &recordingObserver{}
+	New(WithObserver(o), Sleep(10)).Do(func() error { return errorPermanent{s: "permanent"} })
+	want = []string{"started 1", "failed 1 0s", "finished 1"}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("unexpected observer events, got %v want %v", o.events, want)
+	}
+}
+
+func TestWithObserverRecover(t *testing.T) {
+	t.Parallel()
+
+	o := &recordingObserver{}
+	err := New(WithObserver(o), Recover()).Do(panicked)
+	if err == nil || !errors.Is(o.err, err) {
+		t.Errorf("observer should have received the recovered panic error, got %v", o.err)
+	}
+	if o.elapsed <= 0 {
+		t.Errorf("observer should have received the elapsed duration, got %v", o.elapsed)
+	}
+}
+
+type recordingObserver struct {
+	events  []string
+	err     error
+	elapsed time.Duration
+}
+
+func (o *recordingObserver) AttemptStarted(n int) {
+	o.events = append(o.events, fmt.Sprintf("started %d", n))
+}
+
+func (o *recordingObserver) AttemptFailed(n int, err error, backoff time.Duration) {
+	o.events = append(o.events, fmt.Sprintf("failed %d %v", n, backoff))
+}
+
+func (o *recordingObserver) Finished(attempts int, err error, elapsed time.Duration) {
+	o.events = append(o.events, fmt.Sprintf("finished %d", attempts))
+	o.err = err
+	o.elapsed = elapsed
+}
+
+func TestEventChan(t *testing.T) {
+	t.Parallel()
+
+	events := make(chan Event, 10)
+	r := New(EventChan(events), SleepDuration(20*time.Millisecond), Tries(5))
+	r.sleep = (&recordingSleeper{}).sleep
+
+	ab := attemptsBased{succeedOnNth: 3, fn: func() error { return errorTypeA{s: "not yet"} }}
+	if err := r.Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	close(events)
+
+	var got []Event
+	for e := range events {
+		got = append(got, e)
+	}
+	want := []Event{
+		{Attempt: 1, Err: errorTypeA{s: "not yet"}, NextSleep: 20 * time.Millisecond},
+		{Attempt: 2, Err: errorTypeA{s: "not yet"}, NextSleep: 20 * time.Millisecond},
+		{Attempt: 3},
+		{Attempt: 3, Done: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected events, got %v want %v", got, want)
+	}
+}
+
+func TestEventChanNonBlocking(t *testing.T) {
+	t.Parallel()
+
+	// nobody receives from the unbuffered channel, the events are dropped
+	events := make(chan Event)
+	r := New(EventChan(events), Tries(3))
+	if err := r.Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+}
@@ -1,8 +1,13 @@
 package retry
 
-import "time"
+import (
+	"context"
+	"math/rand"
+	"time"
+)
 
-// On configures the Retryer to retry function call on any of the passed in errors.
+// On configures the Retryer to retry function call on any of the passed in errors. Nil entries are ignored. The errors
+// are matched by their type, regardless of being passed by pointer or by value.
 func On(errors []error) func(r *Retryer) {
 	return func(r *Retryer) {
 		r.On = errors
@@ -10,15 +15,122 @@ func On(errors []error) func(r *Retryer) {
 }
 
 // Not configures the Retryer to ignore all of the passed in errors and in case of them appearing doesn't retry
-// function anymore.
+// function anymore. Nil entries are ignored. Errors listed in On as well aren't retried either, unless PreferRetry.
 func Not(errors []error) func(*Retryer) {
 	return func(r *Retryer) {
 		r.Not = errors
 	}
 }
 
+// PreferRetry configures the Retryer to retry errors matching both the On and Not options, e.g. the same error type in
+// both of the slices. The same applies to the message and code based variants of the options.
+func PreferRetry() func(*Retryer) {
+	return func(r *Retryer) {
+		r.PreferRetry = true
+	}
+}
+
+// PreferStop configures the Retryer to consider errors matching both the On and Not options a success, stopping the
+// Retryer. It's the default behaviour, the Not options take precedence over the On options.
+func PreferStop() func(*Retryer) {
+	return func(r *Retryer) {
+		r.PreferRetry = false
+	}
+}
+
+// RetryOnContextErrors configures the Retryer to classify context.Canceled and context.DeadlineExceeded errors, even
+// wrapped ones, as any other error. By default the Retryer stops on them and returns them, as retrying a cancelled
+// operation is almost always wrong. The per-attempt timeouts of DoCtxAttempt are retried regardless of the option.
+func RetryOnContextErrors() func(*Retryer) {
+	return func(r *Retryer) {
+		r.RetryOnContextErrors = true
+	}
+}
+
+// ResetOn configures the Retryer to treat any of the passed in errors as a signal of progress. Such an error is always
+// retried and resets the number of attempts to 0 after the sleep, so the full number of tries applies to genuinely stuck
+// states only. A function returning these errors forever loops forever, so it's recommended to pair the option with a
+// deadline via DoCtx or with StopChan.
+func ResetOn(errors []error) func(*Retryer) {
+	return func(r *Retryer) {
+		r.ResetOn = errors
+	}
+}
+
+// OnMessage configures the Retryer to retry function call on any error, which message contains any of the passed in
+// substrings. Useful for errors without a distinct type. Type based On and Not options take precedence.
+func OnMessage(substrings []string) func(*Retryer) {
+	return func(r *Retryer) {
+		r.OnMessage = substrings
+	}
+}
+
+// NotMessage configures the Retryer to ignore all errors, which message contains any of the passed in substrings and in
+// case of them appearing doesn't retry function anymore. Type based Not option takes precedence.
+func NotMessage(substrings []string) func(*Retryer) {
+	return func(r *Retryer) {
+		r.NotMessage = substrings
+	}
+}
+
+// OnSuccess configures the Retryer to call successFn exactly once, when the function succeeds, passing in the number of
+// the successful attempt. It's not called if the Retryer gives up.
+func OnSuccess(successFn func(int)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.OnSuccessFn = successFn
+	}
+}
+
+// RetryValueIf configures the Retryer to retry the value returning functions of RetryValue and MustDoValue, whenever
+// pred returns true for the value and the error of an attempt, e.g. an HTTP response with the 503 status and a nil
+// error. Otherwise the error is classified as usual. Once the tries are exhausted, the last value is returned along
+// with the error wrapping ErrRejectedValue. The predicate applies only to the functions returning the value of type T.
+func RetryValueIf[T any](pred func(T, error) bool) func(*Retryer) {
+	return func(r *Retryer) {
+		r.valuePred = pred
+	}
+}
+
+// SuccessIf configures the Retryer to consider an attempt successful, if pred returns true for its error, instead of the
+// default err == nil check. Not options and errors, which are not Retryable, are still honored before pred, whereas On
+// options are ignored when pred is set.
+//
+// Since pred fully replaces the default check, it can also treat a nil error as a failure, e.g. to keep polling until a
+// sentinel error signals completion. Combined with Tries(0), such a Retryer polls until the sentinel is returned.
+func SuccessIf(pred func(error) bool) func(*Retryer) {
+	return func(r *Retryer) {
+		r.SuccessFn = pred
+	}
+}
+
+// OnCodes configures the Retryer to retry function call on errors implementing Coder with any of the passed in codes.
+// Errors with other codes are not retried, whereas errors without a code are handled by the other options.
+func OnCodes(codes []int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.OnCodes = codes
+	}
+}
+
+// NotCodes configures the Retryer to ignore errors implementing Coder with any of the passed in codes and in case of
+// them appearing doesn't retry function anymore. Errors without a code are handled by the other options.
+func NotCodes(codes []int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.NotCodes = codes
+	}
+}
+
+// Classifier configures the Retryer to decide about the outcome of each attempt solely by classifierFn, fully replacing
+// the built-in logic of the On, Not, SuccessIf options, the Retryable interface and the default err == nil check. The
+// ResetOn option still applies to errors, which are not classified to stop the Retryer.
+func Classifier(classifierFn func(error) Decision) func(*Retryer) {
+	return func(r *Retryer) {
+		r.ClassifierFn = classifierFn
+	}
+}
+
 // Ensure sets a deferred function to be called, regardless of Retryer succeeding in running the function with or without
-// an error.
+// an error. It's called with the recovered panic as well, if Recover is enabled. Should the function exit the goroutine
+// via runtime.Goexit, the ensureFn still runs with ErrGoexit, while Do never returns.
 func Ensure(ensureFn func(error)) func(*Retryer) {
 	return func(r *Retryer) {
 		r.EnsureFn = ensureFn
@@ -32,14 +144,106 @@ func Recover() func(*Retryer) {
 	}
 }
 
+// RecoverWithStackLimit configures the Retryer to recover panics as Recover does, truncating the stacktrace within the
+// returned error to at most n bytes, keeping the messages of deep stacks short. The limit applies to RecoverAndRetry
+// as well. Values of 0 or less keep the full stacktrace.
+func RecoverWithStackLimit(n int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Recover = true
+		if n < 0 {
+			n = 0
+		}
+		r.StackLimit = n
+	}
+}
+
+// RecoverIf configures the Retryer to recover only the panics, for which pred returns true, e.g. the ones of a known
+// type, converting them into errors as Recover does. Other panics are re-panicked with the same value and propagate out
+// of Do, or DoHedged, so that programmer errors aren't masked. It enables Recover and applies to RecoverAndRetry as
+// well.
+func RecoverIf(pred func(recovered any) bool) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Recover = true
+		r.RecoverIfFn = pred
+	}
+}
+
+// RecoverAndRetry configures the Retryer to recover panics within each attempt. A recovered panic is converted into an
+// error containing the panic and it's stacktrace and handled as any other failed attempt, so the function is retried.
+func RecoverAndRetry() func(*Retryer) {
+	return func(r *Retryer) {
+		r.RecoverAndRetry = true
+	}
+}
+
 // Tries configures to Retryer to keep calling the function until it succeeds tries-times. If 0 is supplied, Retryer
-// will call the function until it succeeds, regardless of number of tries.
+// will call the function until it succeeds, regardless of number of tries. Negative values are clamped to 0 and mean
+// unlimited attempts as well. To catch accidental infinite loops, unlimited attempts require the AllowInfinite opt-in,
+// unless the Retryer can be stopped by StopChan, Timeout or by the context passed to DoCtx; otherwise Do returns
+// ErrInfinite.
 func Tries(tries int) func(r *Retryer) {
 	return func(r *Retryer) {
+		if tries < 0 {
+			tries = 0
+		}
 		r.Tries = tries
 	}
 }
 
+// ExtendTriesOn configures the Retryer to extend the tries of a run by extra, whenever one of the passed in errors
+// occurs, e.g. a warm-up error of a backend needing more patience. The extended tries never exceed the cap, TriesCap if
+// set, otherwise twice the Tries, so that repeated errors can't keep the Retryer going forever. Unlimited tries aren't
+// extended. Nil entries are ignored.
+func ExtendTriesOn(errs []error, extra int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.ExtendOn = errs
+		r.ExtendBy = extra
+	}
+}
+
+// TriesCap configures the cap of the tries extended by the ExtendTriesOn errors. Values below Tries mean Tries.
+func TriesCap(n int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.TriesCap = n
+	}
+}
+
+// NoAutoReset configures the Retryer to skip the implicit Reset at the start of each Do, so that the state of the prior
+// runs is kept and the caller controls it explicitly by calling Reset. A reused Retryer continues the attempt count,
+// the collected errors and the State where the prior run left them, e.g. a second Do continues with the attempts left
+// by the first one and exhausts the tries sooner. StartAttempt applies only to a run starting with 0 attempts.
+func NoAutoReset() func(*Retryer) {
+	return func(r *Retryer) {
+		r.NoAutoReset = true
+	}
+}
+
+// StartAttempt configures the Retryer to resume a run, in which n-1 attempts have already happened, e.g. persisted by
+// a distributed workflow. The first attempt is numbered n, so the backoff continues with its n-th step and Tries
+// accounts for the prior attempts. Reset doesn't clear it, every run of Do starts at the attempt n, while the errors
+// configured by ResetOn restart the numbering from the first attempt.
+func StartAttempt(n int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.StartAttempt = n
+	}
+}
+
+// BeforeEach configures the Retryer to call beforeFn function right before each attempt, including the first one. The
+// order of calls within an attempt is: beforeFn, the function itself, AfterEachFail callback on failure and sleep.
+func BeforeEach(beforeFn func(int)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BeforeEachFn = beforeFn
+	}
+}
+
+// AllowInfinite configures the Retryer to allow unlimited attempts with Tries(0), even if there is no other way of
+// stopping it, than the function succeeding.
+func AllowInfinite() func(*Retryer) {
+	return func(r *Retryer) {
+		r.AllowInfinite = true
+	}
+}
+
 // AfterEachFail configures the Retryer to call failFn function after each of the failed attempts.
 func AfterEachFail(failFn func(error)) func(*Retryer) {
 	return func(r *Retryer) {
@@ -48,13 +252,22 @@ func AfterEachFail(failFn func(error)) func(*Retryer) {
 }
 
 // Sleep configures the Retryer to sleep and delay the next execution of a function for certain duration [ms] after each
-// failed attempt.
+// failed attempt. Prefer SleepDuration, which takes a time.Duration instead of a bare number of milliseconds; Sleep
+// is kept for compatibility.
 func Sleep(dur int) func(*Retryer) {
 	return func(r *Retryer) {
 		r.SleepDur = time.Duration(dur) * time.Millisecond
 	}
 }
 
+// SleepDuration configures the Retryer to sleep and delay the next execution of a function for the duration after each
+// failed attempt.
+func SleepDuration(d time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.SleepDur = d
+	}
+}
+
 // SleepFn configures the Retryer to call a custom, caller supplied function after each failed attempt. SleepFn takes
 // precedence over a set sleep duration.
 func SleepFn(sleepFn func(int)) func(*Retryer) {
@@ -62,3 +275,221 @@ func SleepFn(sleepFn func(int)) func(*Retryer) {
 		r.SleepFn = sleepFn
 	}
 }
+
+// SleepFnErr configures the Retryer to call a custom, caller supplied function after each failed attempt, passing in the
+// error of the failed attempt. SleepFnErr takes precedence over SleepFn, BackoffSelector, BackoffFn and a set sleep
+// duration.
+func SleepFnErr(sleepFn func(int, error)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.SleepFnErr = sleepFn
+	}
+}
+
+// BackoffFn configures the Retryer to sleep after each failed attempt for the duration computed by backoffFn from the
+// current number of attempts. Unlike SleepFn, the sleep is interruptible by the context of DoCtx and capped by MaxSleep.
+// SleepFn and its variants take precedence over BackoffFn, which takes precedence over a set sleep duration.
+func BackoffFn(backoffFn func(int) time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BackoffFn, r.strategy = backoffFn, nil
+	}
+}
+
+// BackoffSelector configures the Retryer to sleep after each failed attempt for the duration computed by selectorFn from
+// the error of the failed attempt and the current number of attempts, e.g. to back off longer on rate limiting errors.
+// BackoffSelector takes precedence over SleepFn, BackoffFn and a set sleep duration, but not over SleepFnErr or
+// SleepFnCtx. The duration is capped by MaxSleep.
+func BackoffSelector(selectorFn func(error, int) time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.BackoffSelectorFn = selectorFn
+	}
+}
+
+// MaxSleep configures the Retryer to sleep at most for the duration after each failed attempt, capping the duration set
+// by Sleep or computed by BackoffFn. Sleeps performed by SleepFn and its variants are not capped.
+func MaxSleep(d time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.MaxSleep = d
+	}
+}
+
+// SleepFnCtx configures the Retryer to call a custom, caller supplied function after each failed attempt, passing in the
+// context of DoCtx, so that the sleep can be interrupted once the context is done. SleepFnCtx takes precedence over all
+// of the other sleep options.
+func SleepFnCtx(sleepFn func(context.Context, int)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.SleepFnCtx = sleepFn
+	}
+}
+
+// EnsureCtx is a context-aware variant of Ensure, passing in the context of DoCtx to the deferred function. The context
+// carries the values of the one passed to DoCtx, e.g. trace IDs, even if it's been derived from it.
+func EnsureCtx(ensureFn func(context.Context, error)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.EnsureCtxFn = ensureFn
+	}
+}
+
+// AfterEachFailCtx is a context-aware variant of AfterEachFail, passing in the context of DoCtx to the failFn function.
+// As with EnsureCtx, request-scoped values of the context are available to the callback.
+func AfterEachFailCtx(failFn func(context.Context, error)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.AfterEachFailCtxFn = failFn
+	}
+}
+
+// WarnFn configures the Retryer to report each of the conflicting options to warnFn once New applies all of them, e.g.
+// Sleep being ignored in favour of SleepFn. The same conflicts are returned from Validate.
+func WarnFn(warnFn func(string)) func(*Retryer) {
+	return func(r *Retryer) {
+		r.WarnFn = warnFn
+	}
+}
+
+// AfterEachFailDecide configures the Retryer to call failFn after each failed attempt with the current # of attempts
+// and the error, same as AfterEachFail does. Returning true stops the Retryer, e.g. once the callback detects a poison
+// message, and Do returns the error wrapped with ErrAborted.
+func AfterEachFailDecide(failFn func(int, error) bool) func(*Retryer) {
+	return func(r *Retryer) {
+		r.AfterEachFailDecideFn = failFn
+	}
+}
+
+// Use configures the Retryer to wrap each attempt with the middleware, applied in the order of registration, i.e. the
+// first one is the outermost. Unlike the callbacks, a middleware can short-circuit the call, transform its error or
+// surround it, e.g. with a tracing span. Repeated calls of Use add to the already registered middleware.
+func Use(mw ...func(next func() error) func() error) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Middleware = append(r.Middleware, mw...)
+	}
+}
+
+// FinalErrorFn configures the Retryer to construct the error returned once the tries are exhausted by finalErrFn, from
+// the # of attempts and the last error, instead of the default RetryError. With CollectErrors, the last error joins the
+// errors of all attempts. To keep errors.Is and errors.As working, the constructed error should wrap the last one, e.g.
+// via %w of fmt.Errorf.
+func FinalErrorFn(finalErrFn func(int, error) error) func(*Retryer) {
+	return func(r *Retryer) {
+		r.FinalErrorFn = finalErrFn
+	}
+}
+
+// ResetBackoffOnSuccess configures the Retryer to reset the internal state of the stateful backoff strategies, i.e. the
+// previous sleep of DecorrelatedJitter, after each success. Such strategies start over on the first attempt of a run
+// on their own, but a Retryer reused across runs, which don't start with the first attempt, e.g. resumed by
+// StartAttempt or NoAutoReset, would otherwise continue the sequence where the last failures left it. The strategies
+// computing the sleep from the # of attempts, e.g. ExponentialBackoff and FibonacciBackoff, have no such state and
+// aren't affected, so with NoAutoReset they keep following the # of attempts accumulated across the runs. Reset doesn't
+// touch the backoff state. Custom SleepFn and BackoffFn functions should derive their state from the # of attempts.
+func ResetBackoffOnSuccess() func(*Retryer) {
+	return func(r *Retryer) {
+		r.ResetBackoffOnSuccess = true
+	}
+}
+
+// StopChan configures the Retryer to stop, once the channel is closed. The closing interrupts any sleep in between the
+// attempts and Do returns ErrStopped instead of invoking the function again. It's a lightweight alternative to DoCtx.
+func StopChan(ch <-chan struct{}) func(*Retryer) {
+	return func(r *Retryer) {
+		r.StopCh = ch
+	}
+}
+
+// WithBudget configures the Retryer to consume a token from the Budget for each retry, the first attempt is free. Once
+// the Budget is exhausted, the Retryer stops retrying and returns the last error wrapped with ErrBudgetExhausted. The
+// token is consumed before the sleep preceding the retry, so the exhausted Budget doesn't delay the error.
+func WithBudget(b *Budget) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Budget = b
+	}
+}
+
+// EventChan configures the Retryer to send an Event to the channel after each attempt and a final one with Done set,
+// once the run is over. The sends never block the Retryer, events are dropped if the channel isn't ready to receive
+// them, so a buffered channel is recommended. The channel isn't closed by the Retryer.
+func EventChan(ch chan<- Event) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Events = ch
+	}
+}
+
+// WithLogger configures the Retryer to notify the Logger about failed attempts being retried, giving up and recovered
+// panics. Use StdLogger to adapt the standard library *log.Logger.
+func WithLogger(l Logger) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Logger = l
+	}
+}
+
+// StopIfUnchanged configures the Retryer to give up once the same error has been returned threshold times in a row,
+// without waiting for all of the tries to be exhausted. Two errors are considered the same, if the latter one Is the
+// former one, or if their messages are equal. The last error is returned wrapped with ErrUnchanged. The polls of
+// DoUntil, which aren't done yet, and the values rejected by RetryValueIf are not counted.
+func StopIfUnchanged(threshold int) func(*Retryer) {
+	return func(r *Retryer) {
+		r.UnchangedThreshold = threshold
+	}
+}
+
+// FailFast configures the Retryer to abort the batch of DoEach once any of the functions fails, skipping the rest.
+func FailFast() func(*Retryer) {
+	return func(r *Retryer) {
+		r.FailFast = true
+	}
+}
+
+// WithObserver configures the Retryer to notify the Observer about each started and failed attempt, including the
+// backoff following it, and about the overall outcome of the run.
+func WithObserver(o Observer) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Observer = o
+	}
+}
+
+// CollectErrors configures the Retryer to keep errors of all the failed attempts and return them joined together, once
+// the tries are exhausted.
+func CollectErrors() func(*Retryer) {
+	return func(r *Retryer) {
+		r.CollectErrors = true
+	}
+}
+
+// Timeout configures the Retryer to give up once the duration elapses since the start of Do, returning a RetryError
+// with TimedOut set. The sleeps between the attempts are shortened to the remaining time, instead of overshooting the
+// deadline. It's combined with the deadline of the context passed to DoCtx, the earlier one applies.
+func Timeout(d time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Timeout = d
+	}
+}
+
+// InitialDelay configures the Retryer to wait for the duration once, before the first attempt. The delay is independent
+// of the sleep between the failed attempts.
+func InitialDelay(d time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.InitialDelay = d
+	}
+}
+
+// AttemptTimeout configures the Retryer to give each attempt of DoCtxAttempt at most the duration, by deriving the
+// per-attempt context with a timeout from the overall one. The deadline never exceeds the overall context's one.
+func AttemptTimeout(d time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.AttemptTimeout = d
+	}
+}
+
+// HedgeDelay configures the Retryer to stagger the concurrent attempts of DoHedged by the duration. A new attempt is
+// started only if none of the in-flight ones has succeeded within the delay.
+func HedgeDelay(d time.Duration) func(*Retryer) {
+	return func(r *Retryer) {
+		r.HedgeDelay = d
+	}
+}
+
+// RandSource configures the Retryer to use the passed in source of randomness in the jittered backoff strategies, e.g.
+// to make them deterministic.
+func RandSource(src rand.Source) func(*Retryer) {
+	return func(r *Retryer) {
+		r.Rand = rand.New(src)
+	}
+}
@@ -1,28 +1,227 @@
 package retry
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"reflect"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 // MaxRetries is the maximum number of retries.
 const MaxRetries = 10
 
+// ErrMaxRetries is matched by the RetryError returned from Do, after all of the tries have been exhausted.
+var ErrMaxRetries = errors.New("max number of retries reached")
+
+// ErrNilFunc is returned from Do, when a nil function is passed in.
+var ErrNilFunc = errors.New("retry: nil function passed to Do")
+
+// ErrInfinite is returned from Do, when the Retryer is configured with unlimited tries without the AllowInfinite opt-in
+// or any other way of stopping it.
+var ErrInfinite = errors.New("retry: unlimited tries require AllowInfinite, a stop channel or a cancellable context")
+
+// ErrBudgetExhausted is wrapped by the error returned from Do, when the shared retry Budget runs out of tokens.
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// ErrUnchanged is wrapped by the error returned from Do, when the same error repeats StopIfUnchanged threshold times.
+var ErrUnchanged = errors.New("repeated identical error")
+
+// ErrSkipped is returned by DoEach for the functions, which haven't been run due to the FailFast option.
+var ErrSkipped = errors.New("retry: skipped after a previous failure")
+
+// ErrNotDone is the error of the attempts of DoUntil, in which the function is not done yet without an error.
+var ErrNotDone = errors.New("retry: not done yet")
+
+// errDone marks the attempts of DoUntil, in which the function is done.
+var errDone = errors.New("retry: done")
+
+// ErrGoexit is passed to the Ensure functions and the Observer, when the function exits the goroutine by a call of
+// runtime.Goexit, e.g. t.Fatal in tests, or by a panic, which isn't recovered. Do never returns in such case, whereas
+// DoHedged, running the function in other goroutines, returns ErrGoexit after runtime.Goexit.
+var ErrGoexit = errors.New("retry: function exited the goroutine")
+
+// ErrConflictingOptions is wrapped by the error returned from Validate, when some of the options are ignored in favour
+// of the others.
+var ErrConflictingOptions = errors.New("retry: conflicting options")
+
+// ErrConcurrentDo is returned from Do, when another run of the same Retryer is in progress. Use Clone to get
+// a Retryer for each goroutine.
+var ErrConcurrentDo = errors.New("retry: concurrent Do on the same Retryer")
+
+// ErrAborted is wrapped by the error returned from Do, when the AfterEachFailDecide callback stops the Retryer.
+var ErrAborted = errors.New("retry aborted by the fail callback")
+
+// ErrRejectedValue is the error, or is wrapped by the error, of the attempts of RetryValue and MustDoValue, whose
+// value is rejected by the RetryValueIf predicate.
+var ErrRejectedValue = errors.New("retry: value rejected")
+
+// ErrStopped is returned from Do, when the stop channel of the Retryer is closed before the function succeeds.
+var ErrStopped = errors.New("retryer has been stopped")
+
+// RetryError is returned from Do, once the tries are exhausted or the deadline of the context passed to DoCtx is
+// exceeded, carrying the metadata about the run. It matches ErrMaxRetries, or the context's error when timed out, and
+// unwraps to the last error.
+type RetryError struct {
+	Attempts int   // Number of the attempts made
+	LastErr  error // Error of the last attempt, or the joined errors of all attempts with the CollectErrors option
+	TimedOut bool  // Whether the run has been ended by the deadline instead of the exhausted tries
+
+	cause     error // Cause of the context, which timed out
+	collected bool  // Whether LastErr holds the errors collected by the CollectErrors option
+}
+
+// Error formats the RetryError, starting with the message of ErrMaxRetries unless timed out.
+func (e *RetryError) Error() string {
+	switch {
+	case e.TimedOut && e.LastErr != nil:
+		return fmt.Sprintf("retry: timed out after %d attempts: %v, last error %v", e.Attempts, e.cause, e.LastErr)
+	case e.TimedOut:
+		return fmt.Sprintf("retry: timed out after %d attempts: %v", e.Attempts, e.cause)
+	case e.collected:
+		return fmt.Sprintf("%v: %d, errors: %v", ErrMaxRetries, e.Attempts, e.LastErr)
+	case e.LastErr != nil:
+		return fmt.Sprintf("%v: %d, last error %v", ErrMaxRetries, e.Attempts, e.LastErr)
+	}
+	return fmt.Sprintf("%v: %d", ErrMaxRetries, e.Attempts)
+}
+
+// Unwrap returns the last error.
+func (e *RetryError) Unwrap() error {
+	return e.LastErr
+}
+
+// Is reports whether the target is ErrMaxRetries, or the context's error when timed out.
+func (e *RetryError) Is(target error) bool {
+	if e.TimedOut {
+		return errors.Is(e.cause, target)
+	}
+	return target == ErrMaxRetries
+}
+
+// Retryable is implemented by errors, which decide on their own whether the failed function call should be retried.
+// An error returning false from Retryable stops the Retryer immediately, regardless of the On and Not options.
+type Retryable interface {
+	Retryable() bool
+}
+
+// Result is the outcome of DoResult, containing metadata about the attempts.
+type Result struct {
+	Attempts      int           // Number of times the function has been invoked
+	Elapsed       time.Duration // Total duration of the run, including the sleeps
+	Err           error         // Error returned by the run, same as Do would return
+	AttemptErrors []error       // Errors of the failed attempts, in order
+
+	AttemptDurations []time.Duration // Durations of the function calls of all attempts, excluding the sleeps, in order
+}
+
+// RetryAfterer is implemented by errors, which dictate how long to wait before the next attempt, e.g. based on the
+// Retry-After header of an HTTP 429 or 503 response. The duration takes precedence over all of the sleep options. It
+// isn't waited for after the last attempt, which no other attempt follows.
+type RetryAfterer interface {
+	RetryAfter() time.Duration
+}
+
+// Decision is the outcome of an attempt, as decided by a classifier.
+type Decision int
+
+const (
+	// DecisionRetry retries the function, if there are any tries left.
+	DecisionRetry Decision = iota
+	// DecisionStop stops the Retryer right away, returning the error of the attempt.
+	DecisionStop
+	// DecisionSuccess considers the attempt successful, the Retryer returns nil.
+	DecisionSuccess
+)
+
+// Coder is implemented by errors carrying an integer code, which can be matched by the OnCodes and NotCodes options.
+type Coder interface {
+	Code() int
+}
+
 // Retryer is configurable runner, which repeats function calls until it succeeds.
 type Retryer struct {
-	Tries    int
-	On       []error       // On is the slice of errors, on which Retryer will retry a function
-	Not      []error       // Not is the slice of errors which Retryer won't consider as needed to retry
-	SleepDur time.Duration // Sleep duration in ms
-	Recover  bool          // If enabled, panics will be recovered.
+	Tries          int           // Tries is the maximum number of attempts, 0 or less means unlimited attempts
+	AllowInfinite  bool          // If enabled, unlimited attempts are allowed without any way of stopping the Retryer
+	ExtendOn       []error       // ExtendOn is the slice of errors, which extend the tries by ExtendBy
+	ExtendBy       int           // Number of the tries added by each of the ExtendOn errors
+	TriesCap       int           // Cap of the tries extended by the ExtendOn errors, 0 means twice the Tries
+	StartAttempt   int           // Number of the first attempt of each run, resuming a run with prior attempts
+	NoAutoReset    bool          // If enabled, Do doesn't Reset the state of the prior runs
+	On             []error       // On is the slice of errors, on which Retryer will retry a function
+	Not            []error       // Not is the slice of errors which Retryer won't consider as needed to retry
+	ResetOn        []error       // ResetOn is the slice of errors signalling progress, which reset the number of attempts
+	OnMessage      []string      // OnMessage is the slice of substrings of error messages, on which Retryer will retry
+	NotMessage     []string      // NotMessage is the slice of substrings of error messages, on which Retryer won't retry
+	OnCodes        []int         // OnCodes is the slice of codes of Coder errors, on which Retryer will retry
+	NotCodes       []int         // NotCodes is the slice of codes of Coder errors, on which Retryer won't retry
+	SleepDur       time.Duration // Sleep duration in ms
+	InitialDelay   time.Duration // Delay before the first attempt
+	Timeout        time.Duration // Overall duration of a run, after which Do gives up, 0 means no timeout
+	HedgeDelay     time.Duration // Delay between starting the concurrent attempts of DoHedged
+	AttemptTimeout time.Duration // Timeout of each attempt of DoCtxAttempt, 0 means only the overall deadline applies
+	MaxSleep       time.Duration // Upper bound of a sleep computed from SleepDur or BackoffFn, 0 means no bound
+	Recover        bool          // If enabled, panics will be recovered.
+
+	RecoverAndRetry bool           // If enabled, panics will be recovered per attempt and handled as failed attempts.
+	StackLimit      int            // Maximum # of bytes of the stacktrace in the recovered panic errors, 0 means no limit
+	RecoverIfFn     func(any) bool // Predicate deciding which panics are recovered, the others are re-panicked
+
+	StopCh                <-chan struct{} // Closing the channel stops the Retryer, interrupting the sleeps
+	Observer              Observer        // Observer notified about each attempt, the backoffs and the overall outcome
+	Events                chan<- Event    // Channel receiving an Event after each attempt without blocking
+	Logger                Logger          // Logger notified about retries, exhaustion and recovered panics
+	Budget                *Budget         // Budget shared with other Retryers, capping the total number of retries
+	UnchangedThreshold    int             // Number of consecutive identical errors stopping the Retryer, 0 means disabled
+	FailFast              bool            // If enabled, DoEach aborts the batch once a function fails
+	PreferRetry           bool            // If enabled, errors matching both the On and Not options are retried
+	RetryOnContextErrors  bool            // If enabled, context.Canceled and context.DeadlineExceeded errors are retried
+	ResetBackoffOnSuccess bool            // If enabled, a success resets the state of the stateful backoff strategies
+	CollectErrors         bool            // If enabled, errors of all failed attempts are returned once the tries run out
+	Rand                  *rand.Rand      // Random source of the jittered backoff strategies, defaults to math/rand
+
+	SleepFn           func(int)                      // Custom sleep function with access to the current # of attempts
+	SleepFnErr        func(int, error)               // SleepFn variant with access to the # of attempts and the last error
+	BackoffFn         func(int) time.Duration        // Custom function computing the sleep duration from the # of attempts
+	BackoffSelectorFn func(error, int) time.Duration // Error-aware BackoffFn, takes precedence over SleepFn and BackoffFn
+
+	EnsureFn        func(error)            // DeferredFn is called after repeated function finishes, regardless of outcome
+	BeforeEachFn    func(int)              // Callback called before each attempt with the current # of attempts
+	AfterEachFailFn func(error)            // Callback called after each of the failures (for example some logging)
+	OnSuccessFn     func(int)              // Callback called once the function succeeds, with the # of the attempt
+	SuccessFn       func(error) bool       // Custom predicate deciding whether an attempt succeeded, replacing err == nil
+	ClassifierFn    func(error) Decision   // Custom classifier of the attempts, replacing all of the built-in logic
+	WarnFn          func(string)           // Callback called by New with each of the conflicting options
+	FinalErrorFn    func(int, error) error // Custom constructor of the error returned once the tries are exhausted
+
+	SleepFnCtx         func(context.Context, int)   // Context-aware variant of SleepFn, takes precedence over the others
+	EnsureCtxFn        func(context.Context, error) // Context-aware variant of EnsureFn
+	AfterEachFailCtxFn func(context.Context, error) // Context-aware variant of AfterEachFailFn
+
+	AfterEachFailDecideFn func(int, error) bool // Variant of AfterEachFailFn, which stops the Retryer by returning true
+
+	Middleware []func(func() error) func() error // Middleware wrapping each attempt, the first one is the outermost
+
+	sleep       func(context.Context, time.Duration) error // Replaceable sleeper, defaults to sleepCtx
+	attempts    int
+	succeededOn int
+	errs        []error
+	lastErr     error
+	repeats     int
+	running     int32 // 1 while a run is in progress, guarding against concurrent runs
 
-	SleepFn         func(int)   // Custom sleep function with access to the current # of attempts
-	EnsureFn        func(error) // DeferredFn is called after repeated function finishes, regardless of outcome
-	AfterEachFailFn func(error) // Callback called after each of the failures (for example some logging)
+	attemptExpired bool // Whether the per-attempt timeout of the last attempt of DoCtxAttempt has expired
+	state          State
+	valuePred      any // func(T, error) bool predicate of RetryValueIf
 
-	attempts int
+	strategy    func(*Retryer, int) time.Duration // Built-in backoff strategy, reading its state from the Retryer
+	backoffPrev time.Duration                     // Previous sleep of the stateful backoff strategies, 0 means none
 }
 
 // Do is wrapper around Retryer, which doesn't expose the Retryer itself, only calls the function until it succeeds.
@@ -31,6 +230,90 @@ func Do(fn func() error, opts ...func(*Retryer)) error {
 	return r.Do(fn)
 }
 
+// DoCtx is wrapper around Retryer, same as Do, which calls the function until it succeeds or the context is done.
+func DoCtx(ctx context.Context, fn func() error, opts ...func(*Retryer)) error {
+	r := New(opts...)
+	return r.DoCtx(ctx, fn)
+}
+
+// Retry is a convenience helper for one-off calls, equivalent to Do. It creates a Retryer with the passed in options
+// and calls the function until it succeeds.
+func Retry(fn func() error, opts ...func(*Retryer)) error {
+	return New(opts...).Do(fn)
+}
+
+// RetryValue calls the value returning function until it succeeds, same as Retry does. It returns the value and the
+// error of the last call.
+func RetryValue[T any](fn func() (T, error), opts ...func(*Retryer)) (T, error) {
+	return doValue(New(opts...), fn)
+}
+
+// MustDo calls the function through the Retryer, same as Do does, and panics with the returned error if it ultimately
+// fails. It's meant for initialization code, e.g. in main or init, where the failure is fatal anyway.
+func MustDo(r *Retryer, fn func() error) {
+	if err := r.Do(fn); err != nil {
+		panic(err)
+	}
+}
+
+// MustDoValue calls the value returning function through the Retryer and returns the value, panicking with the
+// returned error if it ultimately fails, same as MustDo does.
+func MustDoValue[T any](r *Retryer, fn func() (T, error)) T {
+	v, err := doValue(r, fn)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// DoUntilState calls fn through the Retryer, threading the state returned from each attempt into the next one, until
+// done reports the accumulated state as complete, same as DoUntil does. The returned state is adopted even if fn fails.
+// It returns the last state and the error of the Retryer, e.g. once the tries are exhausted.
+func DoUntilState[S any](r *Retryer, initial S, fn func(S) (S, error), done func(S) bool) (S, error) {
+	if fn == nil || done == nil {
+		return initial, ErrNilFunc
+	}
+
+	state := initial
+	err := r.DoUntil(func() (bool, error) {
+		next, err := fn(state)
+		state = next
+		return done(state), err
+	})
+	return state, err
+}
+
+func doValue[T any](r *Retryer, fn func() (T, error)) (T, error) {
+	pred, _ := r.valuePred.(func(T, error) bool)
+
+	var v T
+	err := r.Do(func() error {
+		var err error
+		v, err = fn()
+		if pred != nil && pred(v, err) {
+			if err == nil {
+				return ErrRejectedValue
+			}
+			return &rejectedValueError{err: err}
+		}
+		return err
+	})
+	return v, err
+}
+
+// rejectedValueError is the error of an attempt, whose value and error are rejected by the RetryValueIf predicate.
+type rejectedValueError struct {
+	err error
+}
+
+func (e *rejectedValueError) Error() string {
+	return ErrRejectedValue.Error() + ": " + e.err.Error()
+}
+
+func (e *rejectedValueError) Unwrap() []error {
+	return []error{ErrRejectedValue, e.err}
+}
+
 // New creates a Retryer with applied options.
 func New(opts ...func(*Retryer)) *Retryer {
 	r := &Retryer{Tries: MaxRetries}
@@ -40,50 +323,556 @@ func New(opts ...func(*Retryer)) *Retryer {
 		o(r)
 	}
 
+	if r.WarnFn != nil {
+		for _, c := range r.conflicts() {
+			r.WarnFn(c)
+		}
+	}
 	return r
 }
 
-// Reset resets the state of the Retryer to the default starting one, resetting the number of attempts to 0.
+// Validate reports the conflicting options of the Retryer, in which one of the options is silently ignored in favour
+// of another, e.g. Sleep together with SleepFn. The returned error wraps ErrConflictingOptions.
+func (r *Retryer) Validate() error {
+	if conflicts := r.conflicts(); len(conflicts) > 0 {
+		return fmt.Errorf("%w: %s", ErrConflictingOptions, strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// conflicts describes the options, which are ignored in favour of the others taking precedence.
+func (r *Retryer) conflicts() []string {
+	var conflicts []string
+
+	// sleep strategies in the order of their precedence
+	sleeps := []struct {
+		name string
+		set  bool
+	}{
+		{"SleepFnCtx", r.SleepFnCtx != nil},
+		{"SleepFnErr", r.SleepFnErr != nil},
+		{"BackoffSelector", r.BackoffSelectorFn != nil},
+		{"SleepFn", r.SleepFn != nil},
+		{"BackoffFn", r.BackoffFn != nil || r.strategy != nil},
+		{"Sleep", r.SleepDur != 0},
+	}
+	winner := ""
+	for _, s := range sleeps {
+		switch {
+		case !s.set:
+		case winner == "":
+			winner = s.name
+		default:
+			conflicts = append(conflicts, fmt.Sprintf("%s is ignored in favour of %s", s.name, winner))
+		}
+	}
+
+	if r.ClassifierFn != nil {
+		matchers := []struct {
+			name string
+			set  bool
+		}{
+			{"On", len(r.On) > 0},
+			{"Not", len(r.Not) > 0},
+			{"OnMessage", len(r.OnMessage) > 0},
+			{"NotMessage", len(r.NotMessage) > 0},
+			{"OnCodes", len(r.OnCodes) > 0},
+			{"NotCodes", len(r.NotCodes) > 0},
+			{"SuccessIf", r.SuccessFn != nil},
+		}
+		for _, m := range matchers {
+			if m.set {
+				conflicts = append(conflicts, fmt.Sprintf("%s is ignored in favour of Classifier", m.name))
+			}
+		}
+	}
+	return conflicts
+}
+
+// Reset resets the state of the Retryer to the default starting one, resetting the number of attempts to 0, clearing
+// the successful attempt, dropping the errors collected by the CollectErrors option and the consecutive identical
+// errors tracked by the StopIfUnchanged option, and clearing the State of DoWithState. Only the per-run state is
+// touched, the configuration is preserved.
 func (r *Retryer) Reset() {
 	r.attempts = 0
+	r.succeededOn = 0
+	r.errs = nil
+	r.lastErr = nil
+	r.repeats = 0
+	r.attemptExpired = false
+	r.state = State{}
+}
+
+// Clone returns a copy of the Retryer with the same configuration and a fresh, zeroed state, including the state of the
+// backoff strategies. Config scalars and the On, Not, ResetOn and ExtendOn slices, including the message and code ones,
+// and the Middleware are copied, whereas callback functions are shared by reference. The random source isn't shared,
+// as it isn't safe for concurrent use, the clone uses the math/rand one unless configured by RandSource again.
+func (r *Retryer) Clone() *Retryer {
+	c := *r
+	c.On = append([]error(nil), r.On...)
+	c.Not = append([]error(nil), r.Not...)
+	c.ResetOn = append([]error(nil), r.ResetOn...)
+	c.ExtendOn = append([]error(nil), r.ExtendOn...)
+	c.OnMessage = append([]string(nil), r.OnMessage...)
+	c.NotMessage = append([]string(nil), r.NotMessage...)
+	c.OnCodes = append([]int(nil), r.OnCodes...)
+	c.NotCodes = append([]int(nil), r.NotCodes...)
+	c.Middleware = append([]func(func() error) func() error(nil), r.Middleware...)
+	c.Rand = nil
+	c.running = 0
+	c.backoffPrev = 0
+	c.Reset()
+
+	return &c
 }
 
 // Do calls the passed in function until it succeeds. The behaviour of the retry mechanism heavily relies on the config
 // of the Retryer.
-func (r *Retryer) Do(fn func() error) (err error) {
-	// reset the state to starting one, 0 attempts
+func (r *Retryer) Do(fn func() error) error {
+	if fn != nil && r.single() {
+		return r.doOnce(fn)
+	}
+	return r.DoCtx(context.Background(), fn)
+}
+
+// DoCtx calls the passed in function until it succeeds, same as Do does, or until the context is done. The context is
+// checked before each attempt and interrupts the initial delay and sleeps between attempts, in which case the context's
+// error is returned. Custom sleep and callback functions can observe the context via their context-aware variants.
+// Combined with unlimited tries, e.g. Tries(0), it retries forever until the context is done, e.g. in a daemon.
+func (r *Retryer) DoCtx(ctx context.Context, fn func() error) error {
+	return r.do(ctx, withoutCtx(fn), nil)
+}
+
+// DoCtxAttempt calls the passed in function until it succeeds or until the context is done, same as DoCtx does, passing
+// in a per-attempt context. It's derived from the context of the run, which is cancelled by the stop channel and bound
+// by Timeout as well. With AttemptTimeout set, its deadline is the earlier one of the overall deadline and the timeout,
+// so that the function can cancel its own I/O within each attempt.
+func (r *Retryer) DoCtxAttempt(ctx context.Context, fn func(context.Context) error) error {
+	if fn == nil {
+		return r.do(ctx, nil, nil)
+	}
+	return r.do(ctx, func(ctx context.Context) error {
+		if r.AttemptTimeout <= 0 {
+			return fn(ctx)
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, r.AttemptTimeout)
+		defer cancel()
+		err := fn(attemptCtx)
+		r.attemptExpired = attemptCtx.Err() != nil && ctx.Err() == nil
+		return err
+	}, nil)
+}
+
+// DoWithAttempt calls the passed in function until it succeeds, same as Do does, passing in the current, 1-based number
+// of the attempt. Useful for functions varying their behaviour on later attempts, e.g. with a longer timeout.
+func (r *Retryer) DoWithAttempt(fn func(int) error) error {
+	if fn == nil {
+		return r.Do(nil)
+	}
+	return r.Do(func() error {
+		return fn(r.attempts)
+	})
+}
+
+// DoEach calls each of the passed in functions until it succeeds, same as Do does, one after another with a fresh
+// number of attempts. It returns the errors of the functions aligned index-wise, nil for the ones which succeeded. With
+// FailFast enabled, the batch is aborted once a function fails, the remaining ones get ErrSkipped.
+func (r *Retryer) DoEach(fns []func() error) []error {
+	errs := make([]error, len(fns))
+	for i, fn := range fns {
+		errs[i] = r.Do(fn)
+		if errs[i] != nil && r.FailFast {
+			for j := i + 1; j < len(fns); j++ {
+				errs[j] = ErrSkipped
+			}
+			break
+		}
+	}
+	return errs
+}
+
+// DoUntil calls the passed in polling function until it's done. Returning done stops the Retryer as a success,
+// regardless of the error. Not being done without an error is retried, wrapped as ErrNotDone in the final error, once
+// the tries are exhausted. Not being done with an error is classified as usual.
+func (r *Retryer) DoUntil(fn func() (bool, error)) error {
+	if fn == nil {
+		return r.Do(nil)
+	}
+	return r.Do(func() error {
+		done, err := fn()
+		switch {
+		case done:
+			return errDone
+		case err == nil:
+			return ErrNotDone
+		}
+		return err
+	})
+}
+
+// DoResult calls the passed in function until it succeeds, same as Do does, and returns the outcome together with
+// metadata about the attempts.
+func (r *Retryer) DoResult(fn func() error) Result {
+	var res Result
+	start := time.Now()
+	res.Err = r.do(context.Background(), withoutCtx(fn), &res)
+	res.Attempts = r.attempts
+	res.Elapsed = time.Since(start)
+
+	return res
+}
+
+// single reports whether the Retryer makes a single attempt without any of the options affecting the run, apart from
+// the classification of the error, so that Do can take the fast path of doOnce.
+func (r *Retryer) single() bool {
+	return r.Tries == 1 && r.StartAttempt <= 1 && !r.NoAutoReset && len(r.ExtendOn) == 0 && r.Timeout == 0 &&
+		r.InitialDelay == 0 && !r.Recover && !r.RecoverAndRetry && r.StopCh == nil && r.Observer == nil &&
+		r.Events == nil && r.Logger == nil && r.UnchangedThreshold == 0 && !r.CollectErrors && len(r.ResetOn) == 0 &&
+		len(r.Middleware) == 0 && r.SleepDur == 0 && r.SleepFn == nil && r.SleepFnErr == nil && r.SleepFnCtx == nil &&
+		r.BackoffFn == nil && r.strategy == nil && r.BackoffSelectorFn == nil && r.EnsureFn == nil &&
+		r.EnsureCtxFn == nil && r.BeforeEachFn == nil && r.AfterEachFailFn == nil && r.AfterEachFailCtxFn == nil &&
+		r.AfterEachFailDecideFn == nil && r.OnSuccessFn == nil
+}
+
+// doOnce is the fast path of Do for a single attempt, behaving the same as the retry loop of do, without its set up.
+func (r *Retryer) doOnce(fn func() error) error {
+	if !r.begin() {
+		return ErrConcurrentDo
+	}
+	defer r.end()
+
 	r.Reset()
+	r.attempts = 1
+	err := fn()
+	switch r.classify(err) {
+	case DecisionSuccess:
+		r.succeededOn = 1
+		return nil
+	case DecisionStop:
+		return err
+	}
+
+	return r.exhausted(err)
+}
+
+// do runs the retry loop, recording the metadata about the attempts into res, if it's not nil. The function is passed
+// the context of the run, derived with Timeout and the stop channel.
+func (r *Retryer) do(ctx context.Context, fn func(context.Context) error, res *Result) (err error) {
+	if !r.begin() {
+		return ErrConcurrentDo
+	}
+	defer r.end()
 
-	// define the deferred functions
+	// reset the state to starting one, 0 attempts or the prior ones of a resumed run
+	if !r.NoAutoReset {
+		r.Reset()
+	}
+	if r.attempts == 0 && r.StartAttempt > 1 {
+		r.attempts = r.StartAttempt - 1
+	}
+
+	if fn == nil {
+		return ErrNilFunc
+	}
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if err := r.checkInfinite(ctx); err != nil {
+		return err
+	}
+
+	// the stop channel cancels the context, which stays alive for the deferred functions
+	if r.StopCh != nil {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = r.withStop(ctx)
+		defer cancel(nil)
+	}
+	attempt := r.wrap(func() error { return fn(ctx) })
+
+	// define the deferred functions, the observer and the event channel are notified last, once the final error is
+	// known, and the ensure functions see the recovered panic
+	if r.Events != nil {
+		defer func() { r.emit(Event{Attempt: r.attempts, Err: err, Done: true}) }()
+	}
+	if r.Observer != nil {
+		start := time.Now()
+		defer func() { r.Observer.Finished(r.attempts, err, time.Since(start)) }()
+	}
+	if r.EnsureFn != nil {
+		defer func() { r.EnsureFn(err) }()
+	}
+	if r.EnsureCtxFn != nil {
+		defer func() { r.EnsureCtxFn(ctx, err) }()
+	}
 	if r.Recover {
 		defer func() {
-			if r := recover(); r != nil {
-				err = fmt.Errorf("retryer has recovered panic: %v %s", r, debug.Stack())
+			if p := recover(); p != nil {
+				if !r.recoverable(p) {
+					panic(p)
+				}
+				r.logger().Recovered(p)
+				err = r.recovered(p)
 			}
 		}()
 	}
-	if r.EnsureFn != nil {
-		defer r.EnsureFn(err)
+
+	if r.InitialDelay != 0 {
+		if err := r.pause(ctx, r.InitialDelay); err != nil {
+			return r.interrupted(ctx, err, nil)
+		}
 	}
 
-	// retry the function
+	// retry the function, the tries can be extended by the ExtendTriesOn errors
+	tries := r.Tries
 	for {
-		if r.attempts >= r.Tries {
+		if tries > 0 && r.attempts >= tries {
 			break
 		}
+		if stopErr := r.stopped(ctx); stopErr != nil {
+			return r.interrupted(ctx, stopErr, err)
+		}
 		r.attempts++
 
-		err = fn()
-		if r.succeeded(err) {
+		if r.Observer != nil {
+			r.Observer.AttemptStarted(r.attempts)
+		}
+		if r.BeforeEachFn != nil {
+			r.BeforeEachFn(r.attempts)
+		}
+		// the deferred functions see ErrGoexit, unless the call returns
+		err = ErrGoexit
+		if res != nil {
+			start := time.Now()
+			err = r.call(attempt)
+			res.AttemptDurations = append(res.AttemptDurations, time.Since(start))
+		} else {
+			err = r.call(attempt)
+		}
+		decision := r.classify(err)
+		reset := decision != DecisionStop && matchesAny(err, r.ResetOn)
+		if decision == DecisionSuccess && !reset {
+			r.succeededOn = r.attempts
+			if r.ResetBackoffOnSuccess {
+				r.backoffPrev = 0
+			}
+			r.emit(Event{Attempt: r.attempts})
+			if r.OnSuccessFn != nil {
+				r.OnSuccessFn(r.attempts)
+			}
 			return nil
 		}
+		if res != nil {
+			res.AttemptErrors = append(res.AttemptErrors, err)
+		}
+		if decision == DecisionStop {
+			r.observeFailed(err, 0)
+			// the context error of the attempt interrupted by the run's context, e.g. its deadline or the stop channel
+			if contextError(err) && ctx.Err() != nil {
+				return r.interrupted(ctx, context.Cause(ctx), err)
+			}
+			return err
+		}
+		if tries > 0 && r.ExtendBy > 0 && matchesAny(err, r.ExtendOn) {
+			tries = min(tries+r.ExtendBy, r.triesCap())
+		}
+		if r.CollectErrors {
+			r.errs = append(r.errs, err)
+		}
 		if r.AfterEachFailFn != nil {
 			r.AfterEachFailFn(err)
 		}
-		r.trySleep()
+		if r.AfterEachFailCtxFn != nil {
+			r.AfterEachFailCtxFn(ctx, err)
+		}
+		if r.AfterEachFailDecideFn != nil && r.AfterEachFailDecideFn(r.attempts, err) {
+			r.observeFailed(err, 0)
+			return r.giveUp(fmt.Errorf("%w after %d attempts, last error %w", ErrAborted, r.attempts, err))
+		}
+		if r.unchanged(err) {
+			r.observeFailed(err, 0)
+			return r.giveUp(fmt.Errorf("%w %d times: %w", ErrUnchanged, r.repeats, err))
+		}
+		// the budget is spent before the sleep, so that an exhausted one doesn't delay the error
+		retrying := reset || tries <= 0 || r.attempts < tries
+		if retrying && r.Budget != nil && !r.Budget.take() {
+			r.observeFailed(err, 0)
+			return r.giveUp(fmt.Errorf("%w after %d attempts, last error %w", ErrBudgetExhausted, r.attempts, err))
+		}
+		if retrying {
+			r.logger().Retrying(r.attempts, err)
+		}
+		d, known := r.nextSleep(err, retrying)
+		r.observeFailed(err, d)
+		if sleepErr := r.trySleep(ctx, err, d, known, retrying); sleepErr != nil {
+			return r.interrupted(ctx, sleepErr, err)
+		}
+		if reset {
+			r.attempts = 0
+		}
+	}
+
+	// err is nil, if the prior attempts of a resumed run have already exhausted the tries
+	return r.giveUp(r.exhausted(err))
+}
+
+// exhausted builds the error returned once the tries are exhausted, a RetryError unless FinalErrorFn is set.
+func (r *Retryer) exhausted(lastErr error) error {
+	retryErr := &RetryError{Attempts: r.attempts, LastErr: lastErr}
+	if r.CollectErrors && len(r.errs) > 0 {
+		retryErr.LastErr, retryErr.collected = errors.Join(r.errs...), true
+	}
+	if r.FinalErrorFn != nil {
+		return r.FinalErrorFn(retryErr.Attempts, retryErr.LastErr)
+	}
+	return retryErr
+}
+
+// giveUp notifies the Logger, that the Retryer gives up with the error, and returns it.
+func (r *Retryer) giveUp(err error) error {
+	r.logger().Exhausted(r.attempts, err)
+	return err
+}
+
+// unchanged tracks the consecutive identical errors and reports whether the StopIfUnchanged threshold has been reached.
+// Two errors are identical, if the new one Is the previous one, or if their messages are equal. The polls of DoUntil,
+// which aren't done yet, and the values rejected by RetryValueIf aren't errors of the function, so they end the streak.
+func (r *Retryer) unchanged(err error) bool {
+	if r.UnchangedThreshold <= 0 {
+		return false
+	}
+	if errors.Is(err, ErrNotDone) || errors.Is(err, ErrRejectedValue) {
+		r.repeats, r.lastErr = 0, nil
+		return false
+	}
+
+	if r.lastErr != nil && err != nil && (errors.Is(err, r.lastErr) || err.Error() == r.lastErr.Error()) {
+		r.repeats++
+	} else {
+		r.repeats = 1
+	}
+	r.lastErr = err
+
+	return r.repeats >= r.UnchangedThreshold
+}
+
+// begin marks a run of the Retryer as in progress, reporting false if another one already is.
+func (r *Retryer) begin() bool {
+	return atomic.CompareAndSwapInt32(&r.running, 0, 1)
+}
+
+// end marks the run of the Retryer as finished.
+func (r *Retryer) end() {
+	atomic.StoreInt32(&r.running, 0)
+}
+
+// withoutCtx adapts the function, which doesn't take a context, to the one run by do, keeping a nil function nil.
+func withoutCtx(fn func() error) func(context.Context) error {
+	if fn == nil {
+		return nil
+	}
+	return func(context.Context) error { return fn() }
+}
+
+// checkInfinite guards against accidental infinite loops. Unlimited tries are allowed only with the AllowInfinite
+// opt-in, a stop channel or a context, which can be done, including the one with the Timeout.
+func (r *Retryer) checkInfinite(ctx context.Context) error {
+	if r.Tries > 0 || r.AllowInfinite || r.StopCh != nil || ctx.Done() != nil {
+		return nil
+	}
+	return ErrInfinite
+}
+
+// wrap wraps the function with the middleware, so that the first registered one is the outermost.
+func (r *Retryer) wrap(fn func() error) func() error {
+	for _, mw := range slices.Backward(r.Middleware) {
+		fn = mw(fn)
+	}
+	return fn
+}
+
+// call invokes the function once, converting a panic into an error if RecoverAndRetry is enabled.
+func (r *Retryer) call(fn func() error) (err error) {
+	if r.RecoverAndRetry {
+		defer func() {
+			if p := recover(); p != nil {
+				if !r.recoverable(p) {
+					panic(p)
+				}
+				r.logger().Recovered(p)
+				err = r.recovered(p)
+			}
+		}()
+	}
+	return fn()
+}
+
+// recoverable reports whether the recovered panic should be converted into an error, as decided by RecoverIfFn.
+func (r *Retryer) recoverable(p any) bool {
+	return r.RecoverIfFn == nil || r.RecoverIfFn(p)
+}
+
+// recovered converts the recovered panic into an error containing the stacktrace, truncated to StackLimit bytes.
+func (r *Retryer) recovered(p any) error {
+	stack := debug.Stack()
+	if r.StackLimit > 0 && len(stack) > r.StackLimit {
+		stack = stack[:r.StackLimit]
+	}
+	return fmt.Errorf("retryer has recovered panic: %v %s", p, stack)
+}
+
+// Succeeded reports whether the function has succeeded in the most recent run of the Retryer.
+func (r *Retryer) Succeeded() bool {
+	return r.succeededOn > 0
+}
+
+// SucceededOn returns the number of the attempt, on which the function has succeeded in the most recent run of the
+// Retryer, or 0 if it hasn't succeeded.
+func (r *Retryer) SucceededOn() int {
+	return r.succeededOn
+}
+
+// String returns a concise, human-readable summary of the Retryer's configuration. Callbacks are listed by presence.
+func (r *Retryer) String() string {
+	tries := "unlimited"
+	if r.Tries > 0 {
+		tries = strconv.Itoa(r.Tries)
+	}
+
+	sleep := r.SleepDur.String()
+	if r.SleepFn != nil || r.SleepFnErr != nil || r.SleepFnCtx != nil || r.BackoffFn != nil || r.strategy != nil ||
+		r.BackoffSelectorFn != nil {
+		sleep = "custom"
+	}
+
+	rec := "off"
+	switch {
+	case r.RecoverAndRetry:
+		rec = "retry"
+	case r.Recover:
+		rec = "on"
+	}
+
+	var callbacks []string
+	for _, c := range []struct {
+		name string
+		set  bool
+	}{
+		{"before each", r.BeforeEachFn != nil},
+		{"after each fail", r.AfterEachFailFn != nil || r.AfterEachFailCtxFn != nil || r.AfterEachFailDecideFn != nil},
+		{"ensure", r.EnsureFn != nil || r.EnsureCtxFn != nil},
+		{"success if", r.SuccessFn != nil},
+		{"classifier", r.ClassifierFn != nil},
+	} {
+		if c.set {
+			callbacks = append(callbacks, c.name)
+		}
 	}
 
-	return fmt.Errorf("max number of retries reached: %d, last error %v", r.attempts, err)
+	return fmt.Sprintf("Retryer{tries: %s, sleep: %s, recover: %s, on: %d, not: %d, callbacks: [%s]}",
+		tries, sleep, rec, len(r.On)+len(r.OnMessage)+len(r.OnCodes), len(r.Not)+len(r.NotMessage)+len(r.NotCodes),
+		strings.Join(callbacks, ", "))
 }
 
 // Attempts return the number of times Retryer has invoked a function call.
@@ -91,29 +880,275 @@ func (r *Retryer) Attempts() int {
 	return r.attempts
 }
 
+// classify decides about the outcome of an attempt. The markers of DoUntil and RetryValueIf are handled first, matched
+// with errors.Is to recognise them wrapped by the Middleware as well. Then ClassifierFn, if set, fully replaces the
+// built-in logic, which stops on errors, which are not Retryable, and on context.Canceled and context.DeadlineExceeded,
+// unless RetryOnContextErrors is enabled or only the per-attempt timeout of DoCtxAttempt has expired. Otherwise it
+// relies on succeeded.
+func (r *Retryer) classify(err error) Decision {
+	switch {
+	case errors.Is(err, errDone):
+		return DecisionSuccess
+	case errors.Is(err, ErrNotDone), errors.Is(err, ErrRejectedValue):
+		return DecisionRetry
+	}
+	if r.ClassifierFn != nil {
+		return r.ClassifierFn(err)
+	}
+	if !retryable(err) {
+		return DecisionStop
+	}
+	if !r.RetryOnContextErrors && !r.attemptExpired && contextError(err) {
+		return DecisionStop
+	}
+	if r.succeeded(err) {
+		return DecisionSuccess
+	}
+	return DecisionRetry
+}
+
+// succeeded classifies the error of an attempt. Errors matching Not by type, NotMessage by message or NotCodes by code
+// are considered a success, unless PreferRetry is enabled and they match On, OnMessage or OnCodes as well, in which
+// case they are retried. Then, if SuccessFn is set, it solely decides about the rest. Otherwise errors matching On by
+// type or OnMessage by message are retried, in this order. Errors with a code are retried if they match OnCodes, or
+// considered a success if they don't and OnCodes is set. If any of On or OnMessage is set, all other errors are
+// considered a success, otherwise only a nil error is.
 func (r *Retryer) succeeded(err error) bool {
-	for _, e := range r.Not {
-		if reflect.TypeOf(err) == reflect.TypeOf(e) {
+	code, hasCode := errorCode(err)
+
+	if matchesAny(err, r.Not) || containsAny(err, r.NotMessage) || hasCode && slices.Contains(r.NotCodes, code) {
+		onRetry := matchesAny(err, r.On) || containsAny(err, r.OnMessage) || hasCode && slices.Contains(r.OnCodes, code)
+		return !(r.PreferRetry && onRetry)
+	}
+	if r.SuccessFn != nil {
+		return r.SuccessFn(err)
+	}
+	if matchesAny(err, r.On) {
+		return false
+	}
+	if containsAny(err, r.OnMessage) {
+		return false
+	}
+	if hasCode && len(r.OnCodes) > 0 {
+		return !slices.Contains(r.OnCodes, code)
+	}
+
+	if len(r.On) > 0 || len(r.OnMessage) > 0 {
+		return true
+	}
+
+	return err == nil
+}
+
+// contextError reports whether the error is, or wraps, context.Canceled or context.DeadlineExceeded.
+func contextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// errorCode returns the code of the error, if it implements Coder.
+func errorCode(err error) (int, bool) {
+	if err == nil {
+		return 0, false
+	}
+	var c Coder
+	if errors.As(err, &c) {
+		return c.Code(), true
+	}
+	return 0, false
+}
+
+// matchesAny reports whether the error is of the same type as any of the errors, tolerating the pointer and value
+// forms of the same type, e.g. *errorTypeA matches errorTypeA{}. Nil entries are skipped, so they never match, not
+// even a nil error.
+func matchesAny(err error, errs []error) bool {
+	if err == nil {
+		return false
+	}
+	t := baseType(reflect.TypeOf(err))
+	for _, e := range errs {
+		if e == nil {
+			continue
+		}
+		if t == baseType(reflect.TypeOf(e)) {
 			return true
 		}
 	}
-	for _, e := range r.On {
-		if reflect.TypeOf(err) == reflect.TypeOf(e) {
-			return false
+	return false
+}
+
+// baseType returns the element type of a pointer type, otherwise the type itself.
+func baseType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Pointer {
+		return t.Elem()
+	}
+	return t
+}
+
+// containsAny reports whether the message of a non-nil error contains any of the substrings.
+func containsAny(err error, substrings []string) bool {
+	if err == nil {
+		return false
+	}
+	for _, s := range substrings {
+		if strings.Contains(err.Error(), s) {
+			return true
 		}
 	}
+	return false
+}
 
-	if len(r.On) > 0 {
+// retryable reports whether the error allows another attempt. Errors not implementing Retryable are always retryable.
+func retryable(err error) bool {
+	if err == nil {
 		return true
 	}
+	var re Retryable
+	if errors.As(err, &re) {
+		return re.Retryable()
+	}
+	return true
+}
 
-	return err == nil
+// nextSleep returns the duration of the sleep following the failed attempt. An error implementing RetryAfterer dictates
+// the duration, capped by MaxSleep, or no sleep at all, if no retry follows. Otherwise the precedence of the sleep
+// options is: SleepFnCtx, SleepFnErr, BackoffSelectorFn, SleepFn, BackoffFn and SleepDur. It returns false, if the
+// sleep is performed by one of the SleepFn variants, so its duration is not known upfront.
+func (r *Retryer) nextSleep(err error, retrying bool) (time.Duration, bool) {
+	var ra RetryAfterer
+	if errors.As(err, &ra) {
+		if !retrying {
+			return 0, true
+		}
+		return r.capSleep(ra.RetryAfter()), true
+	}
+	if r.customSleep() {
+		return 0, false
+	}
+	return r.backoff(err, r.attempts), true
 }
 
-func (r *Retryer) trySleep() {
-	if r.SleepFn != nil {
+// triesCap returns the cap of the tries extended by the ExtendTriesOn errors, TriesCap or twice the Tries if unset.
+func (r *Retryer) triesCap() int {
+	if r.TriesCap > 0 {
+		return max(r.TriesCap, r.Tries)
+	}
+	return 2 * r.Tries
+}
+
+// customSleep reports whether the Retryer sleeps by one of the SleepFn variants, instead of a known duration.
+func (r *Retryer) customSleep() bool {
+	return r.SleepFnCtx != nil || r.SleepFnErr != nil || r.SleepFn != nil && r.BackoffSelectorFn == nil
+}
+
+// trySleep delays the next attempt, either for the known duration, or by calling one of the SleepFn variants. It
+// returns the context's error, if the context is done. The known duration is shortened to the time remaining until
+// the context's deadline, e.g. the one of Timeout, instead of overshooting it, skipping the following attempt. If no
+// retry follows, such a sleep is skipped entirely, so that the exhausted tries are reported right away.
+func (r *Retryer) trySleep(ctx context.Context, err error, d time.Duration, known, retrying bool) error {
+	switch {
+	case known:
+		if deadline, ok := ctx.Deadline(); ok && d >= time.Until(deadline) {
+			if !retrying {
+				return nil
+			}
+			// sleeping past the deadline is pointless, give up right at it
+			if err := r.pause(ctx, time.Until(deadline)); err != nil || time.Now().Before(deadline) {
+				return err
+			}
+			// the deadline has passed, the context is done right away, if its timer hasn't fired yet
+			<-ctx.Done()
+			return context.Cause(ctx)
+		}
+		if d > 0 {
+			return r.pause(ctx, d)
+		}
+	case r.SleepFnCtx != nil:
+		r.SleepFnCtx(ctx, r.attempts)
+	case r.SleepFnErr != nil:
+		r.SleepFnErr(r.attempts, err)
+	case r.SleepFn != nil:
 		r.SleepFn(r.attempts)
-	} else if r.SleepDur != 0 {
-		time.Sleep(r.SleepDur)
+	}
+	return context.Cause(ctx)
+}
+
+// backoff computes the sleep duration after the attempt from BackoffSelectorFn, BackoffFn or SleepDur in this order,
+// capped by MaxSleep.
+func (r *Retryer) backoff(err error, attempts int) time.Duration {
+	var d time.Duration
+	switch {
+	case r.BackoffSelectorFn != nil:
+		d = r.BackoffSelectorFn(err, attempts)
+	case r.BackoffFn != nil:
+		d = r.BackoffFn(attempts)
+	case r.strategy != nil:
+		d = r.strategy(r, attempts)
+	default:
+		d = r.SleepDur
+	}
+	return r.capSleep(d)
+}
+
+// capSleep caps the sleep duration by MaxSleep, if set.
+func (r *Retryer) capSleep(d time.Duration) time.Duration {
+	if r.MaxSleep > 0 && d > r.MaxSleep {
+		return r.MaxSleep
+	}
+	return d
+}
+
+// withStop derives the context, which is cancelled with ErrStopped as its cause once the stop channel is closed.
+func (r *Retryer) withStop(ctx context.Context) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-r.StopCh:
+			cancel(ErrStopped)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// stopped returns ErrStopped if the stop channel is closed, or the context's cause if the context is done.
+func (r *Retryer) stopped(ctx context.Context) error {
+	select {
+	case <-r.StopCh:
+		return ErrStopped
+	default:
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return nil
+}
+
+// interrupted turns the error of the stopped context into a timed out RetryError, once its deadline is exceeded.
+// Other errors, e.g. cancellation or ErrStopped, are returned as they are.
+func (r *Retryer) interrupted(ctx context.Context, err, lastErr error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = &RetryError{Attempts: r.attempts, LastErr: lastErr, TimedOut: true, cause: err}
+	}
+	return r.giveUp(err)
+}
+
+// pause sleeps for the duration through the sleep function of the Retryer, defaulting to sleepCtx.
+func (r *Retryer) pause(ctx context.Context, d time.Duration) error {
+	if r.sleep != nil {
+		return r.sleep(ctx, d)
+	}
+	return sleepCtx(ctx, d)
+}
+
+// sleepCtx pauses for the duration or until the context is done, in which case the context's cause is returned.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-t.C:
+		return nil
 	}
 }
@@ -1,9 +1,15 @@
 package retry
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"reflect"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -22,212 +28,1944 @@ func TestDo(t *testing.T) {
 	}
 }
 
-func TestDefaultNew(t *testing.T) {
+func TestRetry(t *testing.T) {
 	t.Parallel()
 
-	r := New()
-	if r.Tries != MaxRetries {
-		t.Fatalf("bad tries config, got %d want %d", r.Tries, MaxRetries)
+	if err := Retry(happy); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
 	}
 
-	err := r.Do(happy)
+	ab := attemptsBased{succeedOnNth: 3, fn: sad}
+	if err := Retry(ab.run, Tries(2)); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if ab.attempts != 2 {
+		t.Errorf("incorrect attempts count, got %d want 2", ab.attempts)
+	}
+
+	// errorTypeC is not amongst the ones to retry on, we try only once
+	calls := 0
+	fn := func() error {
+		calls++
+		return errorTypeC{S: "error c triggered"}
+	}
+	if err := Retry(fn, Tries(5), On([]error{errorTypeA{}})); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("incorrect calls count, got %d want 1", calls)
+	}
+}
+
+func TestRetryValue(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	fn := func() (int, error) {
+		calls++
+		if calls < 3 {
+			return 0, errorTypeA{s: "not yet"}
+		}
+		return 42, nil
+	}
+
+	v, err := RetryValue(fn, Tries(5), On([]error{errorTypeA{}}))
 	if err != nil {
-		t.Errorf("should have succeeded without an error, got %v. Retryer state %#v", err, r)
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if v != 42 || calls != 3 {
+		t.Errorf("unexpected result, got value %d after %d calls want 42 after 3 calls", v, calls)
 	}
 
-	err = r.Do(sad)
+	_, err = RetryValue(func() (string, error) { return "", sad() }, Tries(2))
 	if err == nil {
-		t.Errorf("should have failed with an error. Retryer state %#v", r)
+		t.Error("should have failed with an error")
 	}
 }
 
-func TestInfNumberOfTries(t *testing.T) {
+func TestRetryValueIf(t *testing.T) {
 	t.Parallel()
 
-	r := New(Tries(0))
-	if r.Tries != 0 {
-		t.Fatalf("bad tries config, got %d want %d", r.Tries, 0)
+	// the status signals a retry until the backend is available
+	statuses := []int{503, 503, 200}
+	calls := 0
+	fn := func() (int, error) {
+		status := statuses[calls]
+		calls++
+		return status, nil
 	}
+	unavailable := RetryValueIf(func(status int, err error) bool { return status == 503 })
 
-	for i := 0; i <= 1000; i++ {
-		err := r.Do(sad)
-		if err == nil {
-			t.Errorf("should have failed with an error")
+	status, err := RetryValue(fn, Tries(5), unavailable)
+	if err != nil || status != 200 || calls != 3 {
+		t.Errorf("expected the status 200 after 3 calls, got %d after %d calls and %v", status, calls, err)
+	}
+
+	// exhausting the tries returns the last value and the sentinel
+	status, err = RetryValue(func() (int, error) { return 503, nil }, Tries(2), unavailable)
+	if status != 503 || !errors.Is(err, ErrMaxRetries) || !errors.Is(err, ErrRejectedValue) {
+		t.Errorf("expected the last status with the rejected value error, got %d and %v", status, err)
+	}
+
+	// a rejected value with an error otherwise considered a success is retried, keeping the error
+	calls = 0
+	_, err = RetryValue(func() (int, error) { calls++; return 0, errorTypeB{} }, Tries(3), Not([]error{errorTypeB{}}),
+		RetryValueIf(func(_ int, err error) bool { return err != nil }))
+	if calls != 3 || !errors.Is(err, ErrRejectedValue) || !errors.As(err, new(errorTypeB)) {
+		t.Errorf("expected 3 calls and the rejected value error, got %d calls and %v", calls, err)
+	}
+
+	// the predicate doesn't apply to the values of other types
+	v, err := RetryValue(func() (string, error) { return "ok", nil }, unavailable)
+	if v != "ok" || err != nil {
+		t.Errorf("unexpected result, got %q and %v", v, err)
+	}
+}
+
+func TestMustDo(t *testing.T) {
+	t.Parallel()
+
+	ab := attemptsBased{succeedOnNth: 2, fn: sad}
+	MustDo(New(Tries(3)), ab.run)
+	if v := MustDoValue(New(), func() (int, error) { return 42, nil }); v != 42 {
+		t.Errorf("unexpected value, got %d want 42", v)
+	}
+
+	panics := func(fn func()) (p any) {
+		defer func() { p = recover() }()
+		fn()
+		return nil
+	}
+	for name, fn := range map[string]func(){
+		"MustDo":      func() { MustDo(New(Tries(2)), sad) },
+		"MustDoValue": func() { MustDoValue(New(Tries(2)), func() (int, error) { return 0, sad() }) },
+	} {
+		err, ok := panics(fn).(error)
+		if !ok || !errors.Is(err, ErrMaxRetries) {
+			t.Errorf("%s should have panicked with the retry error, got %v", name, err)
 		}
 	}
 }
 
-func TestSleep(t *testing.T) {
+func TestDoWithAttempt(t *testing.T) {
 	t.Parallel()
 
-	// using a ever failing function
-	tcs := []struct {
-		sleep int
-		tries int
-		wait  int
-	}{
-		{
-			sleep: 50,
-			tries: 1,
-			wait:  100,
-		},
-		{
-			sleep: 50,
-			tries: 5,
-			wait:  100,
-		},
+	var received []int
+	fn := func(attempt int) error {
+		received = append(received, attempt)
+		if attempt == 3 {
+			return nil
+		}
+		return errors.New("not yet")
 	}
 
-	for i, tc := range tcs {
-		r := New(Sleep(tc.sleep), Tries(tc.tries))
-		ch := make(chan error)
+	r := New(Tries(5))
+	if err := r.DoWithAttempt(fn); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if !reflect.DeepEqual(received, []int{1, 2, 3}) {
+		t.Errorf("unexpected attempt numbers, got %v want [1 2 3]", received)
+	}
 
-		start := time.Now()
-		go func() {
-			ch <- r.Do(sad)
-		}()
+	if err := r.DoWithAttempt(nil); err != ErrNilFunc {
+		t.Errorf("expected the nil function error, got %v", err)
+	}
+}
 
-		select {
-		case <-time.After(time.Duration((tc.sleep*tc.tries)+tc.wait) * time.Millisecond):
-			t.Errorf("tc %d: should have slept only for %v took too long", i, time.Duration((tc.sleep*tc.tries)+tc.wait)*time.Millisecond)
-		case err := <-ch:
-			// have we finished sooner?
-			if d := time.Since(start); d < time.Duration(tc.sleep*tc.tries)*time.Millisecond {
-				t.Errorf("tc %d: retryer didn't sleep for the desired time, ended after %v", i, d)
-			}
-			if err == nil {
-				t.Errorf("tc %d: should have failed with an error, Retryer state %#v", i, r)
+func TestDoEach(t *testing.T) {
+	t.Parallel()
+
+	ab := attemptsBased{succeedOnNth: 2, fn: sad}
+	fns := []func() error{happy, sad, ab.run, sad}
+
+	errs := New(Tries(3)).DoEach(fns)
+	if len(errs) != len(fns) {
+		t.Fatalf("errors should be aligned with the functions, got %d want %d", len(errs), len(fns))
+	}
+	for i, want := range []bool{false, true, false, true} {
+		if failed := errs[i] != nil; failed != want {
+			t.Errorf("function %d: unexpected outcome, got error %v", i, errs[i])
+		}
+	}
+	if ab.attempts != 1 {
+		t.Errorf("each function should have a fresh attempt count, got %d attempts want 1", ab.attempts)
+	}
+
+	calls := 0
+	counted := func() error {
+		calls++
+		return nil
+	}
+	errs = New(Tries(3), FailFast()).DoEach([]func() error{counted, sad, counted})
+	if errs[0] != nil || !errors.Is(errs[1], ErrMaxRetries) || errs[2] != ErrSkipped {
+		t.Errorf("unexpected errors with fail fast, got %v", errs)
+	}
+	if calls != 1 {
+		t.Errorf("functions after the failed one shouldn't have been called, got %d calls want 1", calls)
+	}
+}
+
+type errorWarmingUp struct{}
+
+func (e errorWarmingUp) Error() string {
+	return "warming up"
+}
+
+func TestExtendTriesOn(t *testing.T) {
+	t.Parallel()
+
+	// the backend warms up for 4 attempts and succeeds on the 6th one, beyond the original tries
+	warmingUp := func() func() error {
+		calls := 0
+		return func() error {
+			calls++
+			switch {
+			case calls <= 4:
+				return errorWarmingUp{}
+			case calls < 6:
+				return errorTypeA{s: "not yet"}
 			}
+			return nil
 		}
 	}
+	r := New(Tries(3), ExtendTriesOn([]error{errorWarmingUp{}}, 1), TriesCap(10))
+	if err := r.Do(warmingUp()); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if r.Attempts() != 6 {
+		t.Errorf("incorrect attempts count, got %d want 6", r.Attempts())
+	}
+
+	// without extending, the tries are exhausted
+	r = New(Tries(3))
+	if err := r.Do(warmingUp()); !errors.Is(err, ErrMaxRetries) || r.Attempts() != 3 {
+		t.Errorf("expected exhaustion after 3 attempts, got %v after %d", err, r.Attempts())
+	}
+
+	// the extensions are capped, by default at twice the tries
+	r = New(Tries(3), ExtendTriesOn([]error{errorWarmingUp{}}, 5))
+	if err := r.Do(func() error { return errorWarmingUp{} }); !errors.Is(err, ErrMaxRetries) || r.Attempts() != 6 {
+		t.Errorf("expected exhaustion after the capped 6 attempts, got %v after %d", err, r.Attempts())
+	}
 }
 
-func TestSleepFn(t *testing.T) {
+func TestNoAutoReset(t *testing.T) {
 	t.Parallel()
 
-	// we want to sleep for 100+200+300 ms = 600 ms -> linearly growing backoff
-	sleepFn := func(attempts int) {
-		sleep := time.Duration(100*attempts) * time.Millisecond
-		time.Sleep(sleep)
+	r := New(Tries(5), NoAutoReset())
+	ab := attemptsBased{succeedOnNth: 3, fn: sad}
+	if err := r.Do(ab.run); err != nil || r.Attempts() != 3 {
+		t.Errorf("expected a success after 3 attempts, got %v after %d", err, r.Attempts())
 	}
 
-	r := New(SleepFn(sleepFn), Tries(3))
-	ch := make(chan error)
-	start := time.Now()
-	go func() {
-		ch <- r.Do(sad)
-	}()
+	// the second run continues the attempt count and exhausts the remaining tries
+	calls := 0
+	err := r.Do(func() error { calls++; return sad() })
+	if !errors.Is(err, ErrMaxRetries) || calls != 2 || r.Attempts() != 5 {
+		t.Errorf("expected exhaustion after 2 more calls, got %v after %d calls and %d attempts", err, calls, r.Attempts())
+	}
 
-	expectedSleepDur := time.Duration(600 * time.Millisecond)
-	select {
-	case <-time.After(expectedSleepDur + 100*time.Millisecond):
-		t.Errorf("should have slept only for %v took too long", expectedSleepDur)
-	case err := <-ch:
-		// have we finished sooner?
-		if d := time.Since(start); d < expectedSleepDur {
-			t.Errorf("retryer didn't sleep for the desired time, ended after %v", d)
+	// an explicit Reset starts over
+	r.Reset()
+	calls = 0
+	if err := r.Do(func() error { calls++; return sad() }); err == nil || calls != 5 {
+		t.Errorf("expected exhaustion after 5 calls, got %v after %d calls", err, calls)
+	}
+}
+
+func TestStartAttempt(t *testing.T) {
+	t.Parallel()
+
+	linear := func(attempts int) time.Duration { return time.Duration(attempts) * 10 * time.Millisecond }
+	calls := 0
+	var seen []int
+	r := New(Tries(5), StartAttempt(3), BackoffFn(linear), BeforeEach(func(n int) { seen = append(seen, n) }))
+	s := &recordingSleeper{}
+	r.sleep = s.sleep
+
+	// the resumed run continues with attempts 3, 4 and 5 and the sleeps growing from the 3rd step
+	err := r.Do(func() error { calls++; return sad() })
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+	}
+	if calls != 3 || r.Attempts() != 5 {
+		t.Errorf("expected 3 calls and 5 attempts, got %d calls and %d attempts", calls, r.Attempts())
+	}
+	if want := []int{3, 4, 5}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("unexpected attempt numbers, got %v want %v", seen, want)
+	}
+	want := []time.Duration{30 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	if !reflect.DeepEqual(s.slept, want) {
+		t.Errorf("unexpected sleeps, got %v want %v", s.slept, want)
+	}
+
+	// Reset doesn't clear the starting attempt, prior attempts exceeding the tries don't call the function at all
+	r = New(Tries(2), StartAttempt(4))
+	r.Reset()
+	calls = 0
+	if err := r.Do(func() error { calls++; return nil }); !errors.Is(err, ErrMaxRetries) || calls != 0 {
+		t.Errorf("expected exhaustion without calling the function, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDoUntil(t *testing.T) {
+	t.Parallel()
+
+	// done with an error is a success, even with a predicate never considering an error successful
+	polls := 0
+	poll := func() (bool, error) {
+		polls++
+		if polls == 3 {
+			return true, errors.New("done with a warning")
 		}
-		if err == nil {
-			t.Errorf("should have failed with an error, Retryer state %#v", r)
+		return false, nil
+	}
+	r := New(Tries(5), On([]error{errorTypeA{}}), SuccessIf(func(err error) bool { return false }))
+	if err := r.DoUntil(poll); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if r.Attempts() != 3 || !r.Succeeded() {
+		t.Errorf("should have succeeded on 3rd attempt, got %d attempts", r.Attempts())
+	}
+
+	// not done loops until the tries are exhausted
+	r = New(Tries(4), On([]error{errorTypeA{}}))
+	err := r.DoUntil(func() (bool, error) { return false, nil })
+	if !errors.Is(err, ErrMaxRetries) || !errors.Is(err, ErrNotDone) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+	}
+	if r.Attempts() != 4 {
+		t.Errorf("incorrect attempts count, got %d want 4", r.Attempts())
+	}
+
+	// not done with an error goes through the usual classification
+	r = New(Tries(4), Not([]error{errorTypeC{}}))
+	if err := r.DoUntil(func() (bool, error) { return false, errorTypeC{} }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+}
+
+func TestDoUntilState(t *testing.T) {
+	t.Parallel()
+
+	// each poll observes one more replica, until the quorum is reached
+	observe := func(seen int) (int, error) { return seen + 1, nil }
+	quorum := func(seen int) bool { return seen >= 3 }
+
+	r := New(Tries(5))
+	seen, err := DoUntilState(r, 0, observe, quorum)
+	if err != nil || seen != 3 || r.Attempts() != 3 {
+		t.Errorf("expected the quorum of 3 after 3 attempts, got %d after %d attempts and %v", seen, r.Attempts(), err)
+	}
+
+	// the failed attempts accumulate the state as well
+	flaky := func(seen int) (int, error) { return seen + 1, errorTypeA{s: "replica down"} }
+	seen, err = DoUntilState(New(Tries(5), On([]error{errorTypeA{}})), 0, flaky, quorum)
+	if err != nil || seen != 3 {
+		t.Errorf("expected the quorum of 3, got %d and %v", seen, err)
+	}
+
+	// the state never satisfying the condition exhausts the tries
+	seen, err = DoUntilState(New(Tries(2)), 0, observe, func(int) bool { return false })
+	if !errors.Is(err, ErrMaxRetries) || seen != 2 {
+		t.Errorf("expected exhaustion with the state of 2, got %d and %v", seen, err)
+	}
+}
+
+func TestDoResult(t *testing.T) {
+	t.Parallel()
+
+	ab := attemptsBased{succeedOnNth: 2, fn: sad}
+	res := New(Sleep(20), Tries(5)).DoResult(ab.run)
+	if res.Err != nil {
+		t.Errorf("should have succeeded without an error, got %v", res.Err)
+	}
+	if res.Attempts != 2 {
+		t.Errorf("incorrect attempts count, got %d want 2", res.Attempts)
+	}
+	if len(res.AttemptErrors) != 1 || res.AttemptErrors[0].Error() != sad().Error() {
+		t.Errorf("unexpected attempt errors, got %v", res.AttemptErrors)
+	}
+	if res.Elapsed < 20*time.Millisecond {
+		t.Errorf("elapsed duration should contain the sleep, got %v", res.Elapsed)
+	}
+
+	res = New(Tries(3)).DoResult(sad)
+	if !errors.Is(res.Err, ErrMaxRetries) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", res.Err)
+	}
+	if res.Attempts != 3 || len(res.AttemptErrors) != 3 {
+		t.Errorf("unexpected metadata, got %d attempts and %d attempt errors want 3 and 3", res.Attempts, len(res.AttemptErrors))
+	}
+}
+
+func TestDoResultAttemptDurations(t *testing.T) {
+	t.Parallel()
+
+	// the attempts get faster, while the sleeps in between aren't measured
+	latencies := []time.Duration{60 * time.Millisecond, 30 * time.Millisecond, 0}
+	calls := 0
+	fn := func() error {
+		time.Sleep(latencies[calls])
+		calls++
+		if calls < len(latencies) {
+			return sad()
+		}
+		return nil
+	}
+
+	res := New(SleepDuration(50*time.Millisecond), Tries(5)).DoResult(fn)
+	if res.Err != nil || len(res.AttemptDurations) != 3 {
+		t.Fatalf("expected a success with 3 attempt durations, got %v and %v", res.Err, res.AttemptDurations)
+	}
+	for i, d := range res.AttemptDurations {
+		if d < latencies[i] || d > latencies[i]+40*time.Millisecond {
+			t.Errorf("attempt %d: duration %v out of the expected range [%v, %v]", i+1, d, latencies[i],
+				latencies[i]+40*time.Millisecond)
 		}
 	}
 }
 
-func TestPanicRecoveryEnabled(t *testing.T) {
+func TestDoSingleTry(t *testing.T) {
+	t.Parallel()
+
+	fns := map[string]func() error{
+		"happy":       happy,
+		"sad":         sad,
+		"type a":      func() error { return errorTypeA{s: "a"} },
+		"type b":      func() error { return errorTypeB{} },
+		"permanent":   func() error { return errorPermanent{} },
+		"cancelled":   func() error { return context.Canceled },
+		"retry after": func() error { return errorRetryAfter{after: time.Millisecond} },
+	}
+	configs := map[string][]func(*Retryer){
+		"plain":   nil,
+		"matched": {On([]error{errorTypeA{}}), Not([]error{errorTypeB{}})},
+	}
+	for cname, opts := range configs {
+		for fname, fn := range fns {
+			fast, general := New(append(opts, Tries(1))...), New(append(opts, Tries(1))...)
+			if !fast.single() {
+				t.Fatalf("%s: the fast path should have been taken", cname)
+			}
+			fastErr, generalErr := fast.Do(fn), general.do(context.Background(), withoutCtx(fn), nil)
+			if !reflect.DeepEqual(fastErr, generalErr) {
+				t.Errorf("%s %s: errors differ, fast path %v, general path %v", cname, fname, fastErr, generalErr)
+			}
+			if fast.Attempts() != general.Attempts() || fast.Succeeded() != general.Succeeded() {
+				t.Errorf("%s %s: states differ, fast path %v, general path %v", cname, fname, fast, general)
+			}
+		}
+	}
+
+	if New(Tries(1), Ensure(func(error) {})).single() || New(Tries(2)).single() {
+		t.Error("the fast path should have been taken only for a single try without any options")
+	}
+}
+
+func TestDoNilFunc(t *testing.T) {
 	t.Parallel()
 
 	defer func() {
 		if r := recover(); r != nil {
-			t.Errorf("retryer with default panic recovery option - Recover - shouldn't have panicked: %v", r)
+			t.Errorf("retryer shouldn't have panicked on a nil function: %v", r)
 		}
 	}()
 
-	// testing retryer with panic recovery
-	err := New(Recover()).Do(panicked)
+	r := New(Recover())
+	if err := r.Do(nil); err != ErrNilFunc {
+		t.Errorf("expected the nil function error, got %v", err)
+	}
+	if r.Attempts() != 0 {
+		t.Errorf("incorrect attempts count, got %d want 0", r.Attempts())
+	}
+	if err := Do(nil); err != ErrNilFunc {
+		t.Errorf("expected the nil function error, got %v", err)
+	}
+}
+
+func TestConcurrentDo(t *testing.T) {
+	t.Parallel()
+
+	r := New(Tries(3))
+	started, release := make(chan struct{}), make(chan struct{})
+	first := make(chan error)
+	go func() {
+		first <- r.Do(func() error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	if err := r.Do(happy); !errors.Is(err, ErrConcurrentDo) {
+		t.Errorf("overlapping Do should have failed with ErrConcurrentDo, got %v", err)
+	}
+	if err := r.DoHedged(2, happy); !errors.Is(err, ErrConcurrentDo) {
+		t.Errorf("overlapping DoHedged should have failed with ErrConcurrentDo, got %v", err)
+	}
+	if err := r.Clone().Do(happy); err != nil {
+		t.Errorf("a clone should have run independently, got %v", err)
+	}
+
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("the first Do should have succeeded, got %v", err)
+	}
+	if err := r.Do(happy); err != nil {
+		t.Errorf("Do should have been allowed once the first one finished, got %v", err)
+	}
+}
+
+func TestDefaultNew(t *testing.T) {
+	t.Parallel()
+
+	r := New()
+	if r.Tries != MaxRetries {
+		t.Fatalf("bad tries config, got %d want %d", r.Tries, MaxRetries)
+	}
+
+	err := r.Do(happy)
+	if err != nil {
+		t.Errorf("should have succeeded without an error, got %v. Retryer state %#v", err, r)
+	}
+
+	err = r.Do(sad)
 	if err == nil {
-		t.Error("expected an error containing panic stacktracke")
+		t.Errorf("should have failed with an error. Retryer state %#v", r)
 	}
-	if !strings.HasPrefix(err.Error(), "retryer has recovered panic: explicit trigger of panic goroutine") ||
-		!strings.Contains(err.Error(), "stack") {
-		t.Errorf("unexpected error returned from panic recovery %v", err)
+}
+
+func TestSucceeded(t *testing.T) {
+	t.Parallel()
+
+	ab := attemptsBased{succeedOnNth: 3, fn: sad}
+	r := New(Tries(5))
+	if err := r.Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if !r.Succeeded() || r.SucceededOn() != 3 {
+		t.Errorf("should have reported success on 3rd attempt, got %v on %d", r.Succeeded(), r.SucceededOn())
+	}
+
+	if err := r.Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if r.Succeeded() || r.SucceededOn() != 0 {
+		t.Errorf("should have reported failure, got %v on %d", r.Succeeded(), r.SucceededOn())
+	}
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	r := New(Tries(3), Sleep(1), CollectErrors(), On([]error{errorTypeA{}}))
+	r.Do(func() error { return errorTypeA{s: "retry me"} })
+	if r.Attempts() != 3 || len(r.errs) != 3 {
+		t.Fatalf("unexpected state after the run, got %d attempts and %d errors", r.Attempts(), len(r.errs))
+	}
+
+	r.Reset()
+	if r.Attempts() != 0 || r.errs != nil {
+		t.Errorf("state should have been cleared, got %d attempts and errors %v", r.Attempts(), r.errs)
+	}
+	if r.Tries != 3 || r.SleepDur != time.Millisecond || !r.CollectErrors || len(r.On) != 1 {
+		t.Errorf("configuration should have been preserved, got %#v", r)
+	}
+}
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	base := New(Tries(3), Recover(), Sleep(10), On([]error{errorTypeA{}}), Not([]error{errorTypeB{}}))
+	base.Do(func() error { return errorTypeA{s: "retry me"} })
+
+	c := base.Clone()
+	if c.Attempts() != 0 {
+		t.Errorf("clone should have a fresh state, got %d attempts", c.Attempts())
+	}
+	if c.Tries != 3 || !c.Recover || c.SleepDur != 10*time.Millisecond || len(c.On) != 1 || len(c.Not) != 1 {
+		t.Errorf("clone should have the same configuration as the base, got %#v", c)
+	}
+
+	c.Tries = 7
+	c.On[0] = errorTypeC{}
+	c.Not = append(c.Not, errorTypeC{})
+	if base.Tries != 3 {
+		t.Errorf("base tries shouldn't have been changed, got %d want 3", base.Tries)
+	}
+	if reflect.TypeOf(base.On[0]) != reflect.TypeOf(errorTypeA{}) || len(base.Not) != 1 {
+		t.Errorf("base errors shouldn't have been changed, got On %v Not %v", base.On, base.Not)
+	}
+	if base.Attempts() != 3 {
+		t.Errorf("base state shouldn't have been changed, got %d attempts want 3", base.Attempts())
+	}
+}
+
+func TestCloneConcurrent(t *testing.T) {
+	t.Parallel()
+
+	// the clones share neither the state of the backoff strategy nor the random source, run with -race
+	base := New(Tries(5), DecorrelatedJitter(time.Microsecond, 10*time.Microsecond, 0), RandSource(rand.NewSource(1)))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := base.Clone().Do(sad); !errors.Is(err, ErrMaxRetries) {
+				t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if c := base.Clone(); c.Rand != nil || c.strategy == nil {
+		t.Errorf("clone should have the strategy without the random source of the base, got %v", c.Rand)
+	}
+	if base.backoffPrev != 0 {
+		t.Errorf("state of the base strategy shouldn't have been changed, got %v", base.backoffPrev)
+	}
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		r    *Retryer
+		want string
+	}{
+		{
+			r:    New(),
+			want: "Retryer{tries: 10, sleep: 0s, recover: off, on: 0, not: 0, callbacks: []}",
+		},
+		{
+			r:    New(Tries(3), Sleep(100), Recover(), On([]error{errorTypeA{}, errorTypeB{}}), Ensure(func(error) {})),
+			want: "Retryer{tries: 3, sleep: 100ms, recover: on, on: 2, not: 0, callbacks: [ensure]}",
+		},
+		{
+			r:    New(Tries(0), SleepFn(func(int) {}), Not([]error{errorTypeC{}}), AfterEachFail(func(error) {}), BeforeEach(func(int) {})),
+			want: "Retryer{tries: unlimited, sleep: custom, recover: off, on: 0, not: 1, callbacks: [before each, after each fail]}",
+		},
+	}
+
+	for i, tc := range tcs {
+		if got := tc.r.String(); got != tc.want {
+			t.Errorf("tc %d: got %q want %q", i, got, tc.want)
+		}
+	}
+}
+
+func TestInfNumberOfTries(t *testing.T) {
+	t.Parallel()
+
+	r := New(Tries(0), AllowInfinite())
+	if r.Tries != 0 {
+		t.Fatalf("bad tries config, got %d want %d", r.Tries, 0)
+	}
+
+	ab := attemptsBased{succeedOnNth: 1000, fn: sad}
+	if err := r.Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if r.Attempts() != 1000 {
+		t.Errorf("incorrect attempts count, got %d want 1000", r.Attempts())
+	}
+}
+
+func TestInfNumberOfTriesEventuallySucceeds(t *testing.T) {
+	t.Parallel()
+
+	// zero value of the Retryer has unlimited tries as well
+	tcs := []*Retryer{New(Tries(0), AllowInfinite()), {AllowInfinite: true}}
+
+	for i, r := range tcs {
+		// the Retryer is reused, the count has to start over with each run
+		for run := 0; run < 2; run++ {
+			calls := 0
+			fn := func() error {
+				calls++
+				if calls < 5000 {
+					return errorTypeA{s: "not yet"}
+				}
+				return nil
+			}
+
+			if err := r.Do(fn); err != nil {
+				t.Errorf("tc %d run %d: should have succeeded without an error, got %v", i, run, err)
+			}
+			if calls != 5000 || r.Attempts() != 5000 {
+				t.Errorf("tc %d run %d: got %d calls and %d attempts want 5000", i, run, calls, r.Attempts())
+			}
+		}
+	}
+}
+
+func TestInfNumberOfTriesOptIn(t *testing.T) {
+	t.Parallel()
+
+	calls := 0
+	fn := func() error {
+		calls++
+		return nil
+	}
+
+	for i, r := range []*Retryer{New(Tries(0)), {}} {
+		if err := r.Do(fn); err != ErrInfinite {
+			t.Errorf("tc %d: expected the infinite tries error, got %v", i, err)
+		}
+	}
+	if err := New(Tries(0)).DoHedged(2, fn); err != ErrInfinite {
+		t.Errorf("expected the infinite tries error, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("function shouldn't have been called, got %d calls", calls)
+	}
+
+	// a stop channel or a cancellable context can stop the Retryer
+	if err := New(Tries(0), StopChan(make(chan struct{}))).Do(fn); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := New(Tries(0)).DoCtx(ctx, fn); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNegativeTries(t *testing.T) {
+	t.Parallel()
+
+	r := New(Tries(-1), AllowInfinite())
+	if r.Tries != 0 {
+		t.Fatalf("bad tries config, got %d want %d", r.Tries, 0)
+	}
+
+	ab := attemptsBased{succeedOnNth: 3, fn: sad}
+	if err := r.Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+}
+
+func TestSleep(t *testing.T) {
+	t.Parallel()
+
+	// using a ever failing function
+	tcs := []struct {
+		sleep int
+		tries int
+		wait  int
+	}{
+		{
+			sleep: 50,
+			tries: 1,
+			wait:  100,
+		},
+		{
+			sleep: 50,
+			tries: 5,
+			wait:  100,
+		},
+	}
+
+	for i, tc := range tcs {
+		r := New(Sleep(tc.sleep), Tries(tc.tries))
+		ch := make(chan error)
+
+		start := time.Now()
+		go func() {
+			ch <- r.Do(sad)
+		}()
+
+		select {
+		case <-time.After(time.Duration((tc.sleep*tc.tries)+tc.wait) * time.Millisecond):
+			t.Errorf("tc %d: should have slept only for %v took too long", i, time.Duration((tc.sleep*tc.tries)+tc.wait)*time.Millisecond)
+		case err := <-ch:
+			// have we finished sooner?
+			if d := time.Since(start); d < time.Duration(tc.sleep*tc.tries)*time.Millisecond {
+				t.Errorf("tc %d: retryer didn't sleep for the desired time, ended after %v", i, d)
+			}
+			if err == nil {
+				t.Errorf("tc %d: should have failed with an error, Retryer state %#v", i, r)
+			}
+		}
+	}
+}
+
+func TestSleepDuration(t *testing.T) {
+	t.Parallel()
+
+	if a, b := New(SleepDuration(50*time.Millisecond)), New(Sleep(50)); a.SleepDur != b.SleepDur {
+		t.Fatalf("sleep durations should match, got %v and %v", a.SleepDur, b.SleepDur)
+	}
+
+	r := New(SleepDuration(50*time.Millisecond), Tries(3))
+	start := time.Now()
+	if err := r.Do(sad); err == nil {
+		t.Errorf("should have failed with an error, Retryer state %#v", r)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > 250*time.Millisecond {
+		t.Errorf("retryer should have slept for 3x50 ms, ended after %v", d)
+	}
+}
+
+func TestSleepFn(t *testing.T) {
+	t.Parallel()
+
+	// we want to sleep for 100+200+300 ms = 600 ms -> linearly growing backoff
+	sleepFn := func(attempts int) {
+		sleep := time.Duration(100*attempts) * time.Millisecond
+		time.Sleep(sleep)
+	}
+
+	r := New(SleepFn(sleepFn), Tries(3))
+	ch := make(chan error)
+	start := time.Now()
+	go func() {
+		ch <- r.Do(sad)
+	}()
+
+	expectedSleepDur := time.Duration(600 * time.Millisecond)
+	select {
+	case <-time.After(expectedSleepDur + 100*time.Millisecond):
+		t.Errorf("should have slept only for %v took too long", expectedSleepDur)
+	case err := <-ch:
+		// have we finished sooner?
+		if d := time.Since(start); d < expectedSleepDur {
+			t.Errorf("retryer didn't sleep for the desired time, ended after %v", d)
+		}
+		if err == nil {
+			t.Errorf("should have failed with an error, Retryer state %#v", r)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	t.Parallel()
+
+	// the sleeps of 50, 100 and 200ms would overshoot the deadline, the last one is shortened to end right at it
+	var slept []time.Duration
+	r := New(Timeout(250*time.Millisecond), ExponentialBackoff(50*time.Millisecond, 2, 0), AllowInfinite())
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return sleepCtx(ctx, d)
+	}
+
+	start := time.Now()
+	err := r.Do(sad)
+	elapsed := time.Since(start)
+
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) || !retryErr.TimedOut || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a timed out RetryError, got %v", err)
+	}
+	if elapsed < 250*time.Millisecond || elapsed > 350*time.Millisecond {
+		t.Errorf("should have ended right at the deadline, took %v", elapsed)
+	}
+	want := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}
+	if len(slept) != 3 || !reflect.DeepEqual(slept[:2], want) || slept[2] > 100*time.Millisecond {
+		t.Errorf("the sleep overshooting the deadline should have been shortened, got %v", slept)
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+
+	// the last attempt isn't followed by a wait for the deadline
+	start = time.Now()
+	err = New(Tries(1), Sleep(5000), Timeout(300*time.Millisecond)).Do(sad)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("should have returned right after the last attempt, took %v", elapsed)
+	}
+	if !errors.As(err, &retryErr) || retryErr.TimedOut || !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected the exhausted tries, got %v", err)
+	}
+
+	// unlimited tries with a timeout don't require the AllowInfinite opt-in
+	if err := New(Tries(0), Timeout(10*time.Millisecond)).Do(sad); errors.Is(err, ErrInfinite) {
+		t.Errorf("timeout should have allowed unlimited tries, got %v", err)
+	}
+}
+
+func TestInitialDelay(t *testing.T) {
+	t.Parallel()
+
+	var calls []time.Duration
+	start := time.Now()
+	fn := func() error {
+		calls = append(calls, time.Since(start))
+		return errors.New("failure")
+	}
+
+	err := New(InitialDelay(100*time.Millisecond), Sleep(20), Tries(3)).Do(fn)
+	if err == nil {
+		t.Error("should have failed with an error")
+	}
+	if len(calls) != 3 {
+		t.Fatalf("incorrect number of calls, got %d want 3", len(calls))
+	}
+	if calls[0] < 100*time.Millisecond || calls[0] > 150*time.Millisecond {
+		t.Errorf("first attempt should have been delayed by the initial delay only, got %v", calls[0])
+	}
+	for i := 1; i < len(calls); i++ {
+		if d := calls[i] - calls[i-1]; d < 20*time.Millisecond || d > 70*time.Millisecond {
+			t.Errorf("attempt %d should have been delayed by the sleep duration only, got %v", i+1, d)
+		}
+	}
+}
+
+func TestMaxSleep(t *testing.T) {
+	t.Parallel()
+
+	tcs := []struct {
+		name string
+		opts []func(*Retryer)
+	}{
+		{
+			name: "backoff",
+			opts: []func(*Retryer){BackoffFn(func(int) time.Duration { return 10 * time.Second })},
+		},
+		{
+			name: "sleep",
+			opts: []func(*Retryer){Sleep(10000)},
+		},
+	}
+
+	for _, tc := range tcs {
+		r := New(append(tc.opts, MaxSleep(20*time.Millisecond), Tries(3))...)
+
+		start := time.Now()
+		if err := r.Do(sad); err == nil {
+			t.Errorf("tc %s: should have failed with an error, Retryer state %#v", tc.name, r)
+		}
+		if d := time.Since(start); d < 60*time.Millisecond || d > time.Second {
+			t.Errorf("tc %s: retryer should have slept for the capped duration, ended after %v", tc.name, d)
+		}
+	}
+}
+
+func TestBackoffFn(t *testing.T) {
+	t.Parallel()
+
+	var requested []int
+	backoffFn := func(attempts int) time.Duration {
+		requested = append(requested, attempts)
+		return time.Duration(10*attempts) * time.Millisecond
+	}
+
+	start := time.Now()
+	if err := New(BackoffFn(backoffFn), Sleep(1000), Tries(3)).Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if d := time.Since(start); d < 60*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("retryer should have slept for 10+20+30 ms, ended after %v", d)
+	}
+	if !reflect.DeepEqual(requested, []int{1, 2, 3}) {
+		t.Errorf("unexpected attempts passed to the backoff function, got %v", requested)
+	}
+}
+
+func TestBackoffSelector(t *testing.T) {
+	t.Parallel()
+
+	var selected []time.Duration
+	selector := func(err error, attempts int) time.Duration {
+		d := 10 * time.Millisecond
+		var rl errorRateLimited
+		if errors.As(err, &rl) {
+			d = 500 * time.Millisecond
+		}
+		selected = append(selected, d)
+		return d
+	}
+
+	seq := []error{errors.New("network blip"), errorRateLimited{}, errors.New("network blip")}
+	i := 0
+	fn := func() error {
+		err := seq[i]
+		i++
+		return err
+	}
+
+	// BackoffSelector takes precedence over SleepFn and Sleep
+	sleepFnCalled := false
+	r := New(BackoffSelector(selector), SleepFn(func(int) { sleepFnCalled = true }), Sleep(1000), Tries(3))
+
+	start := time.Now()
+	if err := r.Do(fn); err == nil {
+		t.Errorf("should have failed with an error, Retryer state %#v", r)
+	}
+	if d := time.Since(start); d < 520*time.Millisecond || d > 900*time.Millisecond {
+		t.Errorf("retryer should have slept for 10+500+10 ms, ended after %v", d)
+	}
+	if sleepFnCalled {
+		t.Error("SleepFn shouldn't have been called when BackoffSelector is set")
+	}
+
+	want := []time.Duration{10 * time.Millisecond, 500 * time.Millisecond, 10 * time.Millisecond}
+	if !reflect.DeepEqual(selected, want) {
+		t.Errorf("unexpected sleeps, got %v want %v", selected, want)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	seq := []error{
+		errorRetryAfter{after: 300 * time.Millisecond}, errors.New("network blip"), errorRetryAfter{after: time.Hour},
+		errors.New("outage"),
+	}
+	i := 0
+	fn := func() error {
+		err := seq[i]
+		i++
+		return err
+	}
+
+	r := New(Sleep(10), SleepFn(func(int) {}), MaxSleep(time.Second), Tries(4))
+	s := &recordingSleeper{}
+	r.sleep = s.sleep
+
+	if err := r.Do(fn); err == nil {
+		t.Error("should have failed with an error")
+	}
+
+	// the SleepFn is used for the errors without a Retry-After, the hour long one is capped by MaxSleep
+	want := []time.Duration{300 * time.Millisecond, time.Second}
+	if !reflect.DeepEqual(s.slept, want) {
+		t.Errorf("unexpected sleeps, got %v want %v", s.slept, want)
+	}
+
+	// no retry follows the last attempt, so its Retry-After isn't slept
+	for _, tries := range []int{1, 2} {
+		r = New(Tries(tries))
+		s = &recordingSleeper{}
+		r.sleep = s.sleep
+		if err := r.Do(func() error { return errorRetryAfter{after: time.Hour} }); err == nil {
+			t.Error("should have failed with an error")
+		}
+		if len(s.slept) != tries-1 {
+			t.Errorf("%d tries: expected %d sleeps, got %v", tries, tries-1, s.slept)
+		}
+	}
+}
+
+func TestPanicRecoveryEnabled(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("retryer with default panic recovery option - Recover - shouldn't have panicked: %v", r)
+		}
+	}()
+
+	// testing retryer with panic recovery
+	err := New(Recover()).Do(panicked)
+	if err == nil {
+		t.Error("expected an error containing panic stacktracke")
+	}
+	if !strings.HasPrefix(err.Error(), "retryer has recovered panic: explicit trigger of panic goroutine") ||
+		!strings.Contains(err.Error(), "stack") {
+		t.Errorf("unexpected error returned from panic recovery %v", err)
+	}
+}
+
+func TestPanicRecoveryDisabled(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("retryer should have panicked with default settings")
+		}
+	}()
+
+	New().Do(panicked)
+}
+func TestRecoverAndRetry(t *testing.T) {
+	t.Parallel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Errorf("retryer with RecoverAndRetry option shouldn't have panicked: %v", r)
+		}
+	}()
+
+	ab := attemptsBased{succeedOnNth: 3, fn: panicked}
+	var fails []error
+	r := New(RecoverAndRetry(), Tries(5), AfterEachFail(func(err error) { fails = append(fails, err) }))
+	if err := r.Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+	if len(fails) != 2 {
+		t.Fatalf("fail callback should have been called twice, got %d", len(fails))
+	}
+	for _, err := range fails {
+		if !strings.HasPrefix(err.Error(), "retryer has recovered panic: explicit trigger of panic goroutine") {
+			t.Errorf("unexpected error returned from panic recovery %v", err)
+		}
+	}
+
+	// exhausting the tries returns the recovered panic as the last error
+	err := New(RecoverAndRetry(), Tries(2)).Do(panicked)
+	if err == nil || !strings.Contains(err.Error(), "explicit trigger of panic") {
+		t.Errorf("expected an error containing the recovered panic, got %v", err)
+	}
+}
+
+func TestRecoverWithStackLimit(t *testing.T) {
+	t.Parallel()
+
+	prefix := "retryer has recovered panic: explicit trigger of panic "
+	for _, opt := range []func(*Retryer){RecoverWithStackLimit(64), RecoverAndRetry()} {
+		r := New(RecoverWithStackLimit(64), opt, Tries(2))
+		err := r.Do(panicked)
+		if err == nil || !strings.Contains(err.Error(), prefix) {
+			t.Fatalf("expected an error containing the recovered panic, got %v", err)
+		}
+		stack := err.Error()[strings.Index(err.Error(), prefix)+len(prefix):]
+		if len(stack) != 64 || !strings.HasPrefix(stack, "goroutine ") {
+			t.Errorf("expected the stacktrace truncated to 64 bytes, got %d bytes: %q", len(stack), stack)
+		}
+	}
+
+	// the default keeps the full stacktrace
+	err := New(Recover()).Do(panicked)
+	if len(err.Error()) <= len(prefix)+64 {
+		t.Errorf("expected the full stacktrace, got %q", err)
+	}
+}
+
+type recoverablePanic struct {
+	reason string
+}
+
+func TestRecoverIf(t *testing.T) {
+	t.Parallel()
+
+	pred := func(p any) bool {
+		_, ok := p.(recoverablePanic)
+		return ok
+	}
+	recoverableFn := func() error { panic(recoverablePanic{reason: "stale connection"}) }
+
+	// the matching panic is recovered into an error, with RecoverAndRetry per attempt
+	err := New(Tries(3), RecoverIf(pred)).Do(recoverableFn)
+	if err == nil || !strings.Contains(err.Error(), "stale connection") {
+		t.Errorf("expected an error containing the recovered panic, got %v", err)
+	}
+	r := New(Tries(3), RecoverAndRetry(), RecoverIf(pred))
+	if err := r.Do(recoverableFn); !errors.Is(err, ErrMaxRetries) || r.Attempts() != 3 {
+		t.Errorf("expected the recovered panics to be retried, got %v after %d attempts", err, r.Attempts())
+	}
+
+	// the other panic propagates out of Do
+	for _, opt := range []func(*Retryer){Recover(), RecoverAndRetry()} {
+		func() {
+			defer func() {
+				if p := recover(); p != "explicit trigger of panic" {
+					t.Errorf("the not matching panic should have propagated, got %v", p)
+				}
+			}()
+			_ = New(Tries(3), opt, RecoverIf(pred)).Do(panicked)
+		}()
+	}
+}
+
+func TestEnsureFnGoexit(t *testing.T) {
+	t.Parallel()
+
+	var ensured error
+	returned := false
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r := New(Tries(3), Ensure(func(err error) { ensured = err }))
+		_ = r.Do(func() error {
+			runtime.Goexit()
+			return nil
+		})
+		returned = true
+	}()
+	<-done
+
+	if returned {
+		t.Error("Do shouldn't have returned after the goroutine exited")
+	}
+	if !errors.Is(ensured, ErrGoexit) {
+		t.Errorf("ensure function should have been called with ErrGoexit, got %v", ensured)
+	}
+}
+
+func TestEnsureFnRecover(t *testing.T) {
+	t.Parallel()
+
+	var ensured error
+	err := New(Recover(), Ensure(func(err error) { ensured = err })).Do(panicked)
+	if err == nil || ensured != err {
+		t.Errorf("ensure function should have been called with the recovered panic %v, got %v", err, ensured)
+	}
+}
+
+func TestEnsureFn(t *testing.T) {
+	t.Parallel()
+
+	touched := false
+	var ensured error
+	toggler := func(err error) {
+		touched = true
+		ensured = err
+	}
+
+	r := New(Ensure(toggler))
+	err := r.Do(sad)
+	if err == nil {
+		t.Errorf("should have succeeded without an error, got %v. Retryer state %#v", err, r)
+	}
+	if !touched {
+		t.Error("ensure function wasn't called")
+	}
+	if ensured != err {
+		t.Errorf("ensure function should have received the returned error, got %v want %v", ensured, err)
+	}
+}
+
+func TestDoCtxCancelledDuringSleepFnCtx(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sleepFn := func(ctx context.Context, attempts int) {
+		select {
+		case <-ctx.Done():
+		case <-time.After(10 * time.Second):
+		}
+	}
+
+	var failCtx, ensureCtx context.Context
+	var ensured error
+	r := New(
+		SleepFnCtx(sleepFn),
+		Tries(5),
+		AfterEachFailCtx(func(ctx context.Context, err error) { failCtx = ctx }),
+		EnsureCtx(func(ctx context.Context, err error) {
+			ensureCtx = ctx
+			ensured = err
+		}),
+	)
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := r.DoCtx(ctx, sad)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("should have returned promptly after the cancellation, took %v", d)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+	if failCtx != ctx || ensureCtx != ctx {
+		t.Error("context-aware callbacks should have received the context of DoCtx")
+	}
+	if ensured != err {
+		t.Errorf("ensure function should have received the returned error, got %v want %v", ensured, err)
+	}
+}
+
+func TestDoCtxInterruptsSleep(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := New(Sleep(10000), Tries(5)).DoCtx(ctx, sad)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("should have returned promptly after the deadline, took %v", d)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context error, got %v", err)
+	}
+
+	// an already done context doesn't invoke the function at all
+	calls := 0
+	err = DoCtx(ctx, func() error {
+		calls++
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || calls != 0 {
+		t.Errorf("expected the context error without any calls, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDoCtxInfinite(t *testing.T) {
+	t.Parallel()
+
+	for _, sleep := range []time.Duration{0, time.Millisecond, time.Hour} {
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls atomic.Int32
+		done := make(chan error)
+		go func() {
+			done <- New(Tries(0), SleepDuration(sleep)).DoCtx(ctx, func() error {
+				calls.Add(1)
+				return sad()
+			})
+		}()
+
+		// keeps retrying until the shutdown
+		time.Sleep(30 * time.Millisecond)
+		select {
+		case err := <-done:
+			t.Fatalf("sleep %v: the infinite loop shouldn't have ended on its own, got %v", sleep, err)
+		default:
+		}
+
+		cancel()
+		start := time.Now()
+		err := <-done
+		if d := time.Since(start); d > 20*time.Millisecond {
+			t.Errorf("sleep %v: should have returned promptly after the cancellation, took %v", sleep, d)
+		}
+		if err != context.Canceled {
+			t.Errorf("sleep %v: expected the context's error, got %v", sleep, err)
+		}
+		if sleep == 0 && calls.Load() < 2 {
+			t.Errorf("should have retried the function, got %d calls", calls.Load())
+		}
+	}
+}
+
+func TestPreferRetry(t *testing.T) {
+	t.Parallel()
+
+	both := []func(*Retryer){Tries(3), On([]error{errorTypeA{}}), Not([]error{errorTypeA{}})}
+	tests := []struct {
+		name     string
+		opts     []func(*Retryer)
+		attempts int
+		wantErr  bool
+	}{
+		{name: "default stops", opts: both, attempts: 1},
+		{name: "prefer stop", opts: append([]func(*Retryer){PreferRetry(), PreferStop()}, both...), attempts: 1},
+		{name: "prefer retry", opts: append([]func(*Retryer){PreferRetry()}, both...), attempts: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New(tt.opts...)
+			err := r.Do(func() error { return errorTypeA{} })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error %v", err)
+			}
+			if r.Attempts() != tt.attempts {
+				t.Errorf("incorrect attempts count, got %d want %d", r.Attempts(), tt.attempts)
+			}
+		})
+	}
+
+	// errors matching only one of the slices aren't affected
+	r := New(Tries(3), PreferRetry(), On([]error{errorTypeA{}}), Not([]error{errorTypeB{}}))
+	if err := r.Do(func() error { return errorTypeB{} }); err != nil || r.Attempts() != 1 {
+		t.Errorf("expected a success after 1 attempt, got %v after %d", err, r.Attempts())
+	}
+}
+
+func TestDoCtxAttempt(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// each blocking attempt is cancelled at the per-attempt timeout
+	var durations []time.Duration
+	blocking := func(ctx context.Context) error {
+		start := time.Now()
+		<-ctx.Done()
+		durations = append(durations, time.Since(start))
+		return ctx.Err()
+	}
+	err := New(Tries(3), AttemptTimeout(20*time.Millisecond)).DoCtxAttempt(ctx, blocking)
+	if !errors.Is(err, ErrMaxRetries) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the exhausted tries with the per-attempt deadline, got %v", err)
+	}
+	if len(durations) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(durations))
+	}
+	for i, d := range durations {
+		if d < 20*time.Millisecond || d > 500*time.Millisecond {
+			t.Errorf("attempt %d: should have been cancelled at the per-attempt timeout, took %v", i+1, d)
+		}
+	}
+
+	// the per-attempt timeout doesn't extend the overall deadline
+	short, cancelShort := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancelShort()
+	deadline, _ := short.Deadline()
+	err = New(AttemptTimeout(time.Minute)).DoCtxAttempt(short, func(ctx context.Context) error {
+		if d, ok := ctx.Deadline(); !ok || d.After(deadline) {
+			t.Errorf("attempt deadline %v exceeds the overall one %v", d, deadline)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the overall context's error, got %v", err)
+	}
+}
+
+func TestDoCtxAttemptRunContext(t *testing.T) {
+	t.Parallel()
+
+	blocking := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	// the Timeout of the run bounds the attempts, with and without the per-attempt timeout
+	for _, opts := range [][]func(*Retryer){{AttemptTimeout(time.Second)}, nil} {
+		start := time.Now()
+		err := New(append(opts, Tries(0), Timeout(50*time.Millisecond))...).DoCtxAttempt(context.Background(), blocking)
+		if d := time.Since(start); d > 500*time.Millisecond {
+			t.Errorf("should have returned at the timeout of the run, took %v", d)
+		}
+		var retryErr *RetryError
+		if !errors.As(err, &retryErr) || !retryErr.TimedOut || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected a timed out RetryError, got %v", err)
+		}
+	}
+
+	// closing the stop channel cancels the attempt in progress
+	stop := make(chan struct{})
+	time.AfterFunc(20*time.Millisecond, func() { close(stop) })
+	start := time.Now()
+	err := New(Tries(3), StopChan(stop)).DoCtxAttempt(context.Background(), blocking)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("should have returned promptly after the stop, took %v", d)
+	}
+	if !errors.Is(err, ErrStopped) {
+		t.Errorf("expected the stopped error, got %v", err)
+	}
+}
+
+func TestCtxCallbacksValues(t *testing.T) {
+	t.Parallel()
+
+	type traceKey struct{}
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-42")
+
+	var failTraces, sleepTraces []any
+	var ensureTrace any
+	r := New(Tries(3), StopChan(make(chan struct{})),
+		AfterEachFailCtx(func(ctx context.Context, err error) { failTraces = append(failTraces, ctx.Value(traceKey{})) }),
+		SleepFnCtx(func(ctx context.Context, _ int) { sleepTraces = append(sleepTraces, ctx.Value(traceKey{})) }),
+		EnsureCtx(func(ctx context.Context, err error) { ensureTrace = ctx.Value(traceKey{}) }),
+	)
+	if err := r.DoCtx(ctx, sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+
+	want := []any{"trace-42", "trace-42", "trace-42"}
+	if !reflect.DeepEqual(failTraces, want) {
+		t.Errorf("fail callback should have retrieved the value on each failure, got %v", failTraces)
+	}
+	if !reflect.DeepEqual(sleepTraces, want) {
+		t.Errorf("sleep function should have retrieved the value on each failure, got %v", sleepTraces)
+	}
+	if ensureTrace != "trace-42" {
+		t.Errorf("ensure function should have retrieved the value, got %v", ensureTrace)
+	}
+}
+
+func TestRetryError(t *testing.T) {
+	t.Parallel()
+
+	// exhausted tries
+	err := New(Tries(3)).Do(func() error { return errorTypeA{} })
+	var retryErr *RetryError
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected a RetryError, got %T: %v", err, err)
+	}
+	if retryErr.Attempts != 3 || retryErr.LastErr != (errorTypeA{}) || retryErr.TimedOut {
+		t.Errorf("unexpected fields of the RetryError: %+v", retryErr)
+	}
+	if !errors.Is(err, ErrMaxRetries) || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the exhausted RetryError should match only ErrMaxRetries, got %v", err)
+	}
+	if errors.Unwrap(err) != (errorTypeA{}) {
+		t.Errorf("expected to unwrap the last error, got %v", errors.Unwrap(err))
+	}
+
+	// exceeded deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = New(Sleep(20), AllowInfinite()).DoCtx(ctx, func() error { return errorTypeB{} })
+	if !errors.As(err, &retryErr) {
+		t.Fatalf("expected a RetryError, got %T: %v", err, err)
+	}
+	if retryErr.Attempts < 1 || retryErr.LastErr != (errorTypeB{}) || !retryErr.TimedOut {
+		t.Errorf("unexpected fields of the RetryError: %+v", retryErr)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrMaxRetries) {
+		t.Errorf("the timed out RetryError should match only the context's error, got %v", err)
+	}
+
+	// cancellation isn't a timeout
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := New().DoCtx(ctx, sad); errors.As(err, &retryErr) || !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the plain context error, got %T: %v", err, err)
+	}
+}
+
+type errorExhausted struct {
+	attempts int
+	err      error
+}
+
+func (e *errorExhausted) Error() string {
+	return fmt.Sprintf("E_RETRY: %d attempts: %v", e.attempts, e.err)
+}
+
+func (e *errorExhausted) Unwrap() error {
+	return e.err
+}
+
+func TestFinalErrorFn(t *testing.T) {
+	t.Parallel()
+
+	finalErrFn := func(attempts int, lastErr error) error { return &errorExhausted{attempts: attempts, err: lastErr} }
+	for _, tries := range []int{1, 3} {
+		err := New(Tries(tries), FinalErrorFn(finalErrFn)).Do(func() error { return errorTypeA{s: "failed"} })
+
+		var exhausted *errorExhausted
+		if !errors.As(err, &exhausted) || exhausted.attempts != tries {
+			t.Fatalf("expected the custom error after %d attempts, got %v", tries, err)
+		}
+		if !errors.As(err, new(errorTypeA)) || errors.Is(err, ErrMaxRetries) {
+			t.Errorf("the custom error should have wrapped only the last error, got %v", err)
+		}
+	}
+
+	// stopping errors are returned as they are
+	err := New(Tries(3), FinalErrorFn(finalErrFn)).Do(func() error { return errorPermanent{} })
+	if _, ok := err.(errorPermanent); !ok {
+		t.Errorf("expected the not retryable error, got %v", err)
+	}
+}
+
+func TestStopChan(t *testing.T) {
+	t.Parallel()
+
+	stop := make(chan struct{})
+	r := New(StopChan(stop), Sleep(10000), Tries(5))
+
+	time.AfterFunc(50*time.Millisecond, func() { close(stop) })
+	start := time.Now()
+	err := r.Do(sad)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("should have returned promptly after the stop, took %v", d)
+	}
+	if !errors.Is(err, ErrStopped) {
+		t.Errorf("expected the stopped error, got %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// already closed channel, the function is not invoked again
+	calls := 0
+	err = New(StopChan(stop)).Do(func() error {
+		calls++
+		return nil
+	})
+	if !errors.Is(err, ErrStopped) || calls != 0 {
+		t.Errorf("expected the stopped error without any calls, got %v after %d calls", err, calls)
+	}
+}
+
+func TestStopChanEnsureCtx(t *testing.T) {
+	t.Parallel()
+
+	// the context derived for the stop channel is cancelled only after the ensure functions
+	var ensureErr error
+	r := New(StopChan(make(chan struct{})), Tries(3), EnsureCtx(func(ctx context.Context, err error) {
+		ensureErr = context.Cause(ctx)
+	}))
+
+	if err := r.Do(happy); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if ensureErr != nil {
+		t.Errorf("ensure function should have got a live context, got %v", ensureErr)
+	}
+}
+
+func TestErrorFnOn(t *testing.T) {
+	t.Parallel()
+
+	r := New(On([]error{errorTypeA{}, errorTypeB{}}))
+	err := r.Do(sad)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// errorTypeC is not amongst the ones to retry on, we try only once
+	fn := func() error { return errorTypeC{S: "error c triggered"} }
+	err = New(Tries(1), On([]error{errorTypeA{}, errorTypeC{}})).Do(fn)
+	if err == nil {
+		t.Errorf("expected errorType error")
+	}
+
+	// errorTypeC is not amongst the ones to retry on, as we supply empty slice of errors, we try only once
+	fn = func() error { return errorTypeC{S: "error c triggered"} }
+	err = New(Tries(1), On([]error{})).Do(fn)
+	if err == nil {
+		t.Errorf("expected errorType error")
+	}
+}
+
+func TestErrorFnNot(t *testing.T) {
+	t.Parallel()
+
+	// errorTypeC is amongst the ones to ignore in the not slice, we expect a success after 1st run
+	errMsg := "error c triggered"
+	fn := func() error { return errorTypeC{S: errMsg} }
+
+	r := New(Tries(3), Not([]error{errorTypeA{}, errorTypeC{}}))
+	err := r.Do(fn)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.attempts)
+	}
+
+	// errorTypeC is not amongst the ones to retry on, we try only once
+	fn = func() error { return errorTypeC{S: "error c triggered"} }
+	err = New(Tries(1), Not([]error{errorTypeA{}, errorTypeB{}})).Do(fn)
+	if err == nil {
+		t.Errorf("expected errorType error")
+	}
+	if !strings.Contains(err.Error(), errMsg) {
+		t.Errorf("unexpected error returned, got: type:%v msg:'%v',  want it to contain: type:%v msg:'%v'", reflect.TypeOf(err), err.Error(), "errorTypeC", errMsg)
+	}
+}
+
+func TestResetOn(t *testing.T) {
+	t.Parallel()
+
+	// 2 stuck errors, 1 progress error, repeated; then only stuck errors
+	calls := 0
+	fn := func() error {
+		calls++
+		if calls <= 9 && calls%3 == 0 {
+			return errorTypeB{s: "progressing"}
+		}
+		return errorTypeA{s: "stuck"}
+	}
+
+	r := New(Tries(3), ResetOn([]error{errorTypeB{}}), Not([]error{errorTypeB{}}))
+	err := r.Do(fn)
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+	}
+	if calls != 12 {
+		t.Errorf("progress errors should have reset the attempts, got %d calls want 12", calls)
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	t.Parallel()
+
+	// message contains one of the substrings, we retry until exhausted
+	r := New(Tries(3), OnMessage([]string{"connection reset", "timeout"}))
+	err := r.Do(func() error { return errors.New("read tcp: connection reset by peer") })
+	if err == nil {
+		t.Error("expected an error after exhausting all of the tries")
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+
+	// message doesn't contain any of the substrings, we try only once
+	err = r.Do(func() error { return errors.New("permission denied") })
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// message contains one of the ignored substrings, we stop after the first attempt
+	r = New(Tries(3), NotMessage([]string{"not found"}))
+	if err := r.Do(func() error { return errors.New("user not found") }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// type based Not takes precedence over OnMessage
+	r = New(Tries(3), Not([]error{errorTypeC{}}), OnMessage([]string{"error c"}))
+	if err := r.Do(func() error { return errorTypeC{S: "error c triggered"} }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	t.Parallel()
+
+	// code 503 is retried until exhausted
+	r := New(Tries(3), OnCodes([]int{502, 503}))
+	if err := r.Do(func() error { return errorCoded{code: 503} }); err == nil {
+		t.Error("expected an error after exhausting all of the tries")
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+
+	// code 400 is not retried
+	if err := r.Do(func() error { return errorCoded{code: 400} }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// errors without a code fall through to the default handling
+	if err := r.Do(sad); err == nil {
+		t.Error("expected an error after exhausting all of the tries")
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
+
+	// wrapped coded error in the NotCodes isn't retried
+	r = New(Tries(3), NotCodes([]int{404}))
+	if err := r.Do(func() error { return fmt.Errorf("fetch: %w", errorCoded{code: 404}) }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+}
+
+func TestSuccessIf(t *testing.T) {
+	t.Parallel()
+
+	errPartial := errors.New("partial success")
+	pred := func(err error) bool { return err == nil || errors.Is(err, errPartial) }
+
+	ab := attemptsBased{succeedOnNth: 10, fn: func() error { return errPartial }}
+	r := New(Tries(5), SuccessIf(pred))
+	if err := r.Do(ab.run); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// other errors are still retried, On option is ignored
+	r = New(Tries(5), SuccessIf(pred), On([]error{errorTypeA{}}))
+	if err := r.Do(sad); err == nil {
+		t.Error("expected an error after exhausting all of the tries")
+	}
+	if r.Attempts() != 5 {
+		t.Errorf("incorrect attempts count, got %d want 5", r.Attempts())
+	}
+
+	// Not is honored before the predicate
+	r = New(Tries(5), SuccessIf(func(error) bool { return false }), Not([]error{errorTypeC{}}))
+	if err := r.Do(func() error { return errorTypeC{} }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
 	}
 }
 
-func TestPanicRecoveryDisabled(t *testing.T) {
+func TestSuccessIfNilRetried(t *testing.T) {
 	t.Parallel()
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Errorf("retryer should have panicked with default settings")
+	errDone := errors.New("done")
+	polls := 0
+	poll := func() error {
+		polls++
+		if polls == 7 {
+			return errDone
 		}
-	}()
+		return nil
+	}
 
-	New().Do(panicked)
+	r := New(Tries(10), SuccessIf(func(err error) bool { return errors.Is(err, errDone) }))
+	if err := r.Do(poll); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if polls != 7 || r.Attempts() != 7 {
+		t.Errorf("should have polled until the sentinel, got %d polls and %d attempts", polls, r.Attempts())
+	}
+
+	// with a limited number of tries, nil errors exhaust the retryer
+	polls = 0
+	err := New(Tries(3), SuccessIf(func(err error) bool { return errors.Is(err, errDone) })).Do(poll)
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected an error after exhausting all of the tries, got %v", err)
+	}
 }
-func TestEnsureFn(t *testing.T) {
-	t.Parallel()
 
-	touched := false
-	toggler := func(error) { touched = true }
+func TestErrorFnNilEntries(t *testing.T) {
+	t.Parallel()
 
-	r := New(Ensure(toggler))
-	err := r.Do(sad)
-	if err == nil {
-		t.Errorf("should have succeeded without an error, got %v. Retryer state %#v", err, r)
+	r := New(Tries(3), Not([]error{nil, &errorTypeC{}}))
+	if err := r.Do(func() error { return &errorTypeC{S: "error c triggered"} }); err != nil {
+		t.Errorf("unexpected error: %v", err)
 	}
-	if !touched {
-		t.Error("ensure function wasn't called")
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
 	}
-}
 
-func TestErrorFnOn(t *testing.T) {
-	t.Parallel()
+	// only the real type matches, other errors are retried
+	if err := r.Do(func() error { return errorTypeA{s: "error a triggered"} }); err == nil {
+		t.Error("expected an error after exhausting all of the tries")
+	}
+	if r.Attempts() != 3 {
+		t.Errorf("incorrect attempts count, got %d want 3", r.Attempts())
+	}
 
-	r := New(On([]error{errorTypeA{}, errorTypeB{}}))
-	err := r.Do(sad)
-	if err != nil {
+	// nil entry in On doesn't make a nil error retried
+	r = New(Tries(3), On([]error{nil, errorTypeA{}}))
+	if err := r.Do(happy); err != nil {
 		t.Errorf("unexpected error: %v", err)
 	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+}
 
-	// errorTypeC is not amongst the ones to retry on, we try only once
-	fn := func() error { return errorTypeC{S: "error c triggered"} }
-	err = New(Tries(1), On([]error{errorTypeA{}, errorTypeC{}})).Do(fn)
-	if err == nil {
-		t.Errorf("expected errorType error")
+func TestErrorFnPointerValue(t *testing.T) {
+	t.Parallel()
+
+	errs := map[string]func() error{
+		"value":   func() error { return errorTypeA{s: "error a triggered"} },
+		"pointer": func() error { return &errorTypeA{s: "error a triggered"} },
 	}
+	for _, entry := range []error{errorTypeA{}, &errorTypeA{}} {
+		for name, fn := range errs {
+			r := New(Tries(3), On([]error{entry}))
+			if err := r.Do(fn); err == nil || r.Attempts() != 3 {
+				t.Errorf("On(%T) should have retried the %s form, got %v after %d attempts", entry, name, err, r.Attempts())
+			}
 
-	// errorTypeC is not amongst the ones to retry on, as we supply empty slice of errors, we try only once
-	fn = func() error { return errorTypeC{S: "error c triggered"} }
-	err = New(Tries(1), On([]error{})).Do(fn)
-	if err == nil {
-		t.Errorf("expected errorType error")
+			r = New(Tries(3), Not([]error{entry}))
+			if err := r.Do(fn); err != nil || r.Attempts() != 1 {
+				t.Errorf("Not(%T) should have stopped on the %s form, got %v after %d attempts", entry, name, err, r.Attempts())
+			}
+		}
 	}
 }
 
-func TestErrorFnNot(t *testing.T) {
+func TestStopIfUnchanged(t *testing.T) {
 	t.Parallel()
 
-	// errorTypeC is amongst the ones to ignore in the not slice, we expect a success after 1st run
-	errMsg := "error c triggered"
-	fn := func() error { return errorTypeC{S: errMsg} }
+	errDown := errors.New("service down")
+	seq := []error{errors.New("timeout"), errDown, errDown, fmt.Errorf("wrapped: %w", errDown), errors.New("timeout")}
+	i := 0
+	fn := func() error {
+		err := seq[i%len(seq)]
+		i++
+		return err
+	}
 
-	r := New(Tries(3), Not([]error{errorTypeA{}, errorTypeC{}}))
+	r := New(Tries(10), StopIfUnchanged(3))
 	err := r.Do(fn)
-	if err != nil {
-		t.Errorf("unexpected error: %v", err)
+	if !errors.Is(err, ErrUnchanged) || !errors.Is(err, errDown) {
+		t.Errorf("expected the repeated error wrapped with ErrUnchanged, got %v", err)
 	}
-	if r.Attempts() != 1 {
-		t.Errorf("incorrect attempts count, got %d want 1", r.attempts)
+	if r.Attempts() != 4 {
+		t.Errorf("should have stopped at the threshold, got %d attempts want 4", r.Attempts())
 	}
 
-	// errorTypeC is not amongst the ones to retry on, we try only once
-	fn = func() error { return errorTypeC{S: "error c triggered"} }
-	err = New(Tries(1), Not([]error{errorTypeA{}, errorTypeB{}})).Do(fn)
-	if err == nil {
-		t.Errorf("expected errorType error")
+	// identical messages count as the same error
+	r = New(Tries(10), StopIfUnchanged(2))
+	if err := r.Do(sad); !errors.Is(err, ErrUnchanged) {
+		t.Errorf("expected the repeated error wrapped with ErrUnchanged, got %v", err)
 	}
-	if !strings.Contains(err.Error(), errMsg) {
-		t.Errorf("unexpected error returned, got: type:%v msg:'%v',  want it to contain: type:%v msg:'%v'", reflect.TypeOf(err), err.Error(), "errorTypeC", errMsg)
+	if r.Attempts() != 2 {
+		t.Errorf("should have stopped at the threshold, got %d attempts want 2", r.Attempts())
+	}
+
+	// the polls, which aren't done yet, and the rejected values aren't counted
+	r = New(Tries(10), StopIfUnchanged(3))
+	if err := r.DoUntil(func() (bool, error) { return false, nil }); !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("DoUntil: expected the exhausted tries, got %v", err)
+	}
+	if r.Attempts() != 10 {
+		t.Errorf("DoUntil: should have polled until the tries were exhausted, got %d attempts want 10", r.Attempts())
+	}
+	_, err = DoUntilState(r, 0, func(n int) (int, error) { return n + 1, nil }, func(n int) bool { return n == 5 })
+	if err != nil || r.Attempts() != 5 {
+		t.Errorf("DoUntilState: expected a success after 5 attempts, got %v after %d", err, r.Attempts())
+	}
+	_, err = RetryValue(func() (int, error) { return 503, nil }, Tries(5), StopIfUnchanged(2),
+		RetryValueIf(func(status int, err error) bool { return status == 503 }))
+	if !errors.Is(err, ErrMaxRetries) || errors.Is(err, ErrUnchanged) {
+		t.Errorf("RetryValueIf: expected the exhausted tries, got %v", err)
+	}
+}
+
+func TestClassifier(t *testing.T) {
+	t.Parallel()
+
+	errRetry := errors.New("retry")
+	errStop := errors.New("stop")
+	errFine := errors.New("fine")
+	classifier := func(err error) Decision {
+		switch err {
+		case errStop:
+			return DecisionStop
+		case errFine, nil:
+			return DecisionSuccess
+		}
+		return DecisionRetry
+	}
+
+	tcs := []struct {
+		err      error
+		attempts int
+		want     error
+	}{
+		{err: errRetry, attempts: 3, want: ErrMaxRetries},
+		{err: errStop, attempts: 1, want: errStop},
+		{err: errFine, attempts: 1},
+		// the built-in Not and Retryable handling is replaced
+		{err: errorTypeC{}, attempts: 3, want: ErrMaxRetries},
+		{err: errorPermanent{}, attempts: 3, want: ErrMaxRetries},
+	}
+
+	for i, tc := range tcs {
+		r := New(Tries(3), Classifier(classifier), Not([]error{errorTypeC{}}))
+		err := r.Do(func() error { return tc.err })
+		if tc.want == nil && err != nil || !errors.Is(err, tc.want) {
+			t.Errorf("tc %d: unexpected error, got %v want %v", i, err, tc.want)
+		}
+		if r.Attempts() != tc.attempts {
+			t.Errorf("tc %d: incorrect attempts count, got %d want %d", i, r.Attempts(), tc.attempts)
+		}
 	}
 }
 
@@ -257,6 +1995,157 @@ func TestAfterEachFail(t *testing.T) {
 	}
 }
 
+func TestAfterEachFailDecide(t *testing.T) {
+	t.Parallel()
+
+	var fails []int
+	r := New(Tries(5), AfterEachFail(func(error) { fails = append(fails, len(fails)+1) }),
+		AfterEachFailDecide(func(attempt int, err error) bool { return attempt == 2 }))
+	err := r.Do(func() error { return errorTypeA{s: "poison message"} })
+	if !errors.Is(err, ErrAborted) || !errors.As(err, new(errorTypeA)) {
+		t.Errorf("expected the aborted error wrapping the last one, got %v", err)
+	}
+	if r.Attempts() != 2 || len(fails) != 2 {
+		t.Errorf("should have stopped on the 2nd attempt, got %d attempts and %d fail callbacks", r.Attempts(), len(fails))
+	}
+
+	// never stopping keeps retrying until the tries are exhausted
+	r = New(Tries(5), AfterEachFailDecide(func(int, error) bool { return false }))
+	if err := r.Do(sad); !errors.Is(err, ErrMaxRetries) || r.Attempts() != 5 {
+		t.Errorf("expected exhaustion after 5 attempts, got %v after %d", err, r.Attempts())
+	}
+}
+
+func TestUse(t *testing.T) {
+	t.Parallel()
+
+	var order []string
+	tracing := func(name string) func(func() error) func() error {
+		return func(next func() error) func() error {
+			return func() error {
+				order = append(order, name+" in")
+				err := next()
+				order = append(order, name+" out")
+				return err
+			}
+		}
+	}
+	invocations := 0
+	counting := func(next func() error) func() error {
+		return func() error {
+			invocations++
+			return next()
+		}
+	}
+
+	r := New(Tries(3), Use(tracing("outer"), counting), Use(tracing("inner")))
+	if err := r.Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if invocations != 3 {
+		t.Errorf("middleware should have been invoked per attempt, got %d want 3", invocations)
+	}
+	if want := []string{"outer in", "inner in", "inner out", "outer out"}; !reflect.DeepEqual(order[:4], want) {
+		t.Errorf("unexpected order of the middleware, got %v want %v", order[:4], want)
+	}
+
+	// transforming a specific error into a success
+	ignoring := func(next func() error) func() error {
+		return func() error {
+			if err := next(); !errors.As(err, new(errorTypeB)) {
+				return err
+			}
+			return nil
+		}
+	}
+	r = New(Tries(3), Use(ignoring))
+	if err := r.Do(func() error { return errorTypeB{} }); err != nil || r.Attempts() != 1 {
+		t.Errorf("expected a success after 1 attempt, got %v after %d", err, r.Attempts())
+	}
+
+	// the markers of DoUntil and RetryValueIf are recognised, even when wrapped by the middleware
+	wrapping := func(next func() error) func() error {
+		return func() error {
+			if err := next(); err != nil {
+				return fmt.Errorf("op: %w", err)
+			}
+			return nil
+		}
+	}
+	polls := 0
+	r = New(Tries(5), Use(wrapping))
+	err := r.DoUntil(func() (bool, error) {
+		polls++
+		return polls == 3, nil
+	})
+	if err != nil || r.Attempts() != 3 {
+		t.Errorf("DoUntil: expected a success after 3 attempts, got %v after %d", err, r.Attempts())
+	}
+
+	statuses := []int{503, 503, 200}
+	calls := 0
+	status, err := RetryValue(func() (int, error) {
+		calls++
+		return statuses[calls-1], nil
+	}, Tries(5), Use(wrapping), RetryValueIf(func(status int, err error) bool { return status == 503 }))
+	if err != nil || status != 200 || calls != 3 {
+		t.Errorf("RetryValueIf: expected the status 200 after 3 calls, got %d after %d calls and %v", status, calls, err)
+	}
+}
+
+func TestBeforeEach(t *testing.T) {
+	t.Parallel()
+
+	var events []string
+	before := func(attempt int) { events = append(events, fmt.Sprintf("before %d", attempt)) }
+	fail := func(error) { events = append(events, "fail") }
+	fn := func() error {
+		events = append(events, "call")
+		return errors.New("failure")
+	}
+
+	err := New(BeforeEach(before), AfterEachFail(fail), Tries(3)).Do(fn)
+	if err == nil {
+		t.Error("should have failed with an error")
+	}
+	want := []string{"before 1", "call", "fail", "before 2", "call", "fail", "before 3", "call", "fail"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("unexpected order of calls, got %v want %v", events, want)
+	}
+
+	calls := 0
+	err = New(BeforeEach(func(int) { calls++ }), Tries(3)).Do(happy)
+	if err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("before each callback should have been called once, got %d", calls)
+	}
+}
+
+func TestOnSuccess(t *testing.T) {
+	t.Parallel()
+
+	var succeeded []int
+	onSuccess := func(attempt int) { succeeded = append(succeeded, attempt) }
+
+	ab := attemptsBased{succeedOnNth: 3, fn: sad}
+	if err := New(OnSuccess(onSuccess), Tries(5)).Do(ab.run); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if !reflect.DeepEqual(succeeded, []int{3}) {
+		t.Errorf("success callback should have been called once on 3rd attempt, got %v", succeeded)
+	}
+
+	succeeded = nil
+	if err := New(OnSuccess(onSuccess), Tries(5)).Do(sad); err == nil {
+		t.Error("should have failed with an error")
+	}
+	if len(succeeded) != 0 {
+		t.Errorf("success callback shouldn't have been called, got %v", succeeded)
+	}
+}
+
 func TestCombinedOptions(t *testing.T) {
 	t.Parallel()
 
@@ -309,6 +2198,178 @@ func TestSleepFnPriorityOverSleep(t *testing.T) {
 	}
 }
 
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	var warnings []string
+	r := New(SleepFn(func(int) {}), Sleep(1000), WarnFn(func(w string) { warnings = append(warnings, w) }))
+	err := r.Validate()
+	if !errors.Is(err, ErrConflictingOptions) || !strings.Contains(err.Error(), "Sleep is ignored in favour of SleepFn") {
+		t.Errorf("expected the Sleep and SleepFn conflict, got %v", err)
+	}
+	if want := []string{"Sleep is ignored in favour of SleepFn"}; !reflect.DeepEqual(warnings, want) {
+		t.Errorf("unexpected warnings, got %v want %v", warnings, want)
+	}
+
+	r = New(Classifier(func(error) Decision { return DecisionStop }), On([]error{errorTypeA{}}), BackoffFn(
+		func(int) time.Duration { return 0 }), SleepFnErr(func(int, error) {}))
+	want := []string{"BackoffFn is ignored in favour of SleepFnErr", "On is ignored in favour of Classifier"}
+	if !reflect.DeepEqual(r.conflicts(), want) {
+		t.Errorf("unexpected conflicts, got %v want %v", r.conflicts(), want)
+	}
+
+	if err := New(Sleep(100), Tries(3), On([]error{errorTypeA{}})).Validate(); err != nil {
+		t.Errorf("unexpected conflicts: %v", err)
+	}
+}
+
+func TestContextErrors(t *testing.T) {
+	t.Parallel()
+
+	wrapped := fmt.Errorf("query failed: %w", context.Canceled)
+	for _, ctxErr := range []error{wrapped, context.DeadlineExceeded} {
+		r := New(Tries(3))
+		if err := r.Do(func() error { return ctxErr }); err != ctxErr || r.Attempts() != 1 {
+			t.Errorf("%v should have stopped the Retryer right away, got %v after %d attempts", ctxErr, err, r.Attempts())
+		}
+
+		r = New(Tries(3), RetryOnContextErrors())
+		if err := r.Do(func() error { return ctxErr }); !errors.Is(err, ErrMaxRetries) || r.Attempts() != 3 {
+			t.Errorf("%v should have been retried with the opt-out, got %v after %d attempts", ctxErr, err, r.Attempts())
+		}
+	}
+}
+
+func TestRetryableInterface(t *testing.T) {
+	t.Parallel()
+
+	permanent := errorPermanent{s: "permanent failure"}
+	fn := func() error { return permanent }
+
+	r := New(Tries(5))
+	err := r.Do(fn)
+	if err != permanent {
+		t.Errorf("expected the non-retryable error to be returned as is, got %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// the interface takes precedence over the Not and On options
+	r = New(Tries(5), Not([]error{errorPermanent{}}), On([]error{errorPermanent{}}))
+	err = r.Do(fn)
+	if err != permanent {
+		t.Errorf("expected the non-retryable error to be returned as is, got %v", err)
+	}
+	if r.Attempts() != 1 {
+		t.Errorf("incorrect attempts count, got %d want 1", r.Attempts())
+	}
+
+	// errors signalling that they are retryable are retried as usual
+	r = New(Tries(5))
+	err = r.Do(func() error { return errorTransient{} })
+	if err == nil {
+		t.Error("expected an error after exhausting all of the tries")
+	}
+	if r.Attempts() != 5 {
+		t.Errorf("incorrect attempts count, got %d want 5", r.Attempts())
+	}
+}
+
+func TestFinalErrorUnwrap(t *testing.T) {
+	t.Parallel()
+
+	err := New(Tries(3)).Do(func() error { return errorTypeC{S: "error c triggered"} })
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected the error to wrap ErrMaxRetries, got %v", err)
+	}
+
+	var c errorTypeC
+	if !errors.As(err, &c) {
+		t.Fatalf("expected the typed cause to be recoverable, got %v", err)
+	}
+	if c.S != "error c triggered" {
+		t.Errorf("unexpected cause recovered, got %v", c)
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	t.Parallel()
+
+	errA := errors.New("first failure")
+	errB := errors.New("second failure")
+	errC := errors.New("third failure")
+	seq := []error{errA, errB, errC}
+
+	i := 0
+	fn := func() error {
+		err := seq[i]
+		i++
+		return err
+	}
+
+	err := New(Tries(3), CollectErrors()).Do(fn)
+	if err == nil {
+		t.Fatal("expected an error after exhausting all of the tries")
+	}
+	if !errors.Is(err, ErrMaxRetries) {
+		t.Errorf("expected the error to wrap ErrMaxRetries, got %v", err)
+	}
+	for _, e := range seq {
+		if !errors.Is(err, e) {
+			t.Errorf("expected the error to wrap %v, got %v", e, err)
+		}
+		if !strings.Contains(err.Error(), e.Error()) {
+			t.Errorf("expected the error message to contain '%v', got '%v'", e, err)
+		}
+	}
+
+	// without the option, only the last error is reported
+	i = 0
+	err = New(Tries(3)).Do(fn)
+	if strings.Contains(err.Error(), errA.Error()) || !strings.Contains(err.Error(), errC.Error()) {
+		t.Errorf("expected only the last error to be reported, got '%v'", err)
+	}
+}
+
+func TestSleepFnErr(t *testing.T) {
+	t.Parallel()
+
+	var sleeps []time.Duration
+	sleepFn := func(attempts int, err error) {
+		sleep := time.Millisecond
+		var rl errorRateLimited
+		if errors.As(err, &rl) {
+			sleep = rl.after
+		}
+		sleeps = append(sleeps, sleep)
+		time.Sleep(sleep)
+	}
+
+	seq := []error{errors.New("network blip"), errorRateLimited{after: 30 * time.Millisecond}, errors.New("network blip")}
+	i := 0
+	fn := func() error {
+		err := seq[i]
+		i++
+		return err
+	}
+
+	// SleepFnErr takes precedence over SleepFn
+	sleepFnCalled := false
+	r := New(SleepFnErr(sleepFn), SleepFn(func(int) { sleepFnCalled = true }), Tries(3))
+	if err := r.Do(fn); err == nil {
+		t.Errorf("should have failed with an error, Retryer state %#v", r)
+	}
+	if sleepFnCalled {
+		t.Error("SleepFn shouldn't have been called when SleepFnErr is set")
+	}
+
+	want := []time.Duration{time.Millisecond, 30 * time.Millisecond, time.Millisecond}
+	if !reflect.DeepEqual(sleeps, want) {
+		t.Errorf("unexpected sleeps, got %v want %v", sleeps, want)
+	}
+}
+
 type errorTypeA struct {
 	s string
 }
@@ -333,6 +2394,60 @@ func (e errorTypeC) Error() string {
 	return e.S
 }
 
+type errorPermanent struct {
+	s string
+}
+
+func (e errorPermanent) Error() string {
+	return e.s
+}
+
+func (e errorPermanent) Retryable() bool {
+	return false
+}
+
+type errorTransient struct{}
+
+func (e errorTransient) Error() string {
+	return "transient error"
+}
+
+func (e errorTransient) Retryable() bool {
+	return true
+}
+
+type errorCoded struct {
+	code int
+}
+
+func (e errorCoded) Error() string {
+	return fmt.Sprintf("error with code %d", e.code)
+}
+
+func (e errorCoded) Code() int {
+	return e.code
+}
+
+type errorRetryAfter struct {
+	after time.Duration
+}
+
+func (e errorRetryAfter) Error() string {
+	return "service unavailable"
+}
+
+func (e errorRetryAfter) RetryAfter() time.Duration {
+	return e.after
+}
+
+type errorRateLimited struct {
+	after time.Duration
+}
+
+func (e errorRateLimited) Error() string {
+	return "rate limited"
+}
+
 func happy() error {
 	_ = 2 + 3
 	return nil
@@ -361,3 +2476,19 @@ func (ab *attemptsBased) run() error {
 	ab.attempts++
 	return ab.fn()
 }
+
+func BenchmarkDoSingleTry(b *testing.B) {
+	r := New(Tries(1))
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = r.Do(happy)
+	}
+}
+
+func BenchmarkDoSingleTryGeneral(b *testing.B) {
+	r := New(Tries(1))
+	b.ReportAllocs()
+	for b.Loop() {
+		_ = r.DoCtx(context.Background(), happy)
+	}
+}
@@ -0,0 +1,32 @@
+package retry
+
+// State is a store of values persisting across the attempts of a DoWithState run, e.g. a cursor or a connection to
+// reuse. It's cleared by Reset, so each run starts with an empty State. State isn't safe for concurrent use.
+type State struct {
+	values map[string]any
+}
+
+// Get returns the value stored under the key and whether there is any.
+func (s *State) Get(key string) (any, bool) {
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set stores the value under the key, replacing the previous one.
+func (s *State) Set(key string, v any) {
+	if s.values == nil {
+		s.values = make(map[string]any)
+	}
+	s.values[key] = v
+}
+
+// DoWithState calls the passed in function until it succeeds, same as Do does, passing in the State shared by all of
+// the attempts of the run.
+func (r *Retryer) DoWithState(fn func(*State) error) error {
+	if fn == nil {
+		return r.Do(nil)
+	}
+	return r.Do(func() error {
+		return fn(&r.state)
+	})
+}
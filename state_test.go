@@ -0,0 +1,32 @@
+package retry
+
+import "testing"
+
+func TestDoWithState(t *testing.T) {
+	t.Parallel()
+
+	var cursors []any
+	fn := func(s *State) error {
+		cursor, ok := s.Get("cursor")
+		cursors = append(cursors, cursor)
+		if !ok {
+			s.Set("cursor", 42)
+			return errorTypeA{s: "interrupted"}
+		}
+		return nil
+	}
+
+	r := New(Tries(3))
+	if err := r.DoWithState(fn); err != nil {
+		t.Errorf("should have succeeded without an error, got %v", err)
+	}
+	if len(cursors) != 2 || cursors[0] != nil || cursors[1] != 42 {
+		t.Errorf("the 2nd attempt should have read the value stored by the 1st one, got %v", cursors)
+	}
+
+	// the next run starts with an empty State
+	cursors = nil
+	if err := r.DoWithState(fn); err != nil || len(cursors) != 2 || cursors[0] != nil {
+		t.Errorf("the State should have been cleared, got %v and %v", cursors, err)
+	}
+}